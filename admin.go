@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/crabkun/crab/config"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type adminServer struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Mux         bool      `json:"mux"`
+	PortKeys    []string  `json:"port_keys"`
+	Sessions    int64     `json:"sessions"`
+	// protocol version, 0 for servers of older versions
+	Version int `json:"version"`
+}
+
+type adminSession struct {
+	Id         string    `json:"id"`
+	PortKey    string    `json:"port_key"`
+	ServerName string    `json:"server_name"`
+	ClientAddr string    `json:"client_addr"`
+	StartedAt  time.Time `json:"started_at"`
+	Duration   float64   `json:"duration"`
+	Upload     int64     `json:"upload"`
+	Download   int64     `json:"download"`
+}
+
+// serveAdmin serves the admin api:
+//
+//	GET    /servers          list connected servers and their port keys
+//	DELETE /servers/<id>     kick a server
+//	DELETE /port_keys/<id>   unregister a port key and close its sessions
+//	GET    /sessions         list clients being relayed
+//	DELETE /sessions/<id>    close a session
+func serveAdmin(cfg *config.AdminConfig) {
+	l := log.WithFields(log.Fields{
+		"admin_listen": cfg.Listen,
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/servers", adminListServers)
+	mux.HandleFunc("/servers/", adminKickServer)
+	mux.HandleFunc("/port_keys/", adminRevokePortKey)
+	mux.HandleFunc("/sessions", adminListSessions)
+	mux.HandleFunc("/sessions/", adminCloseSession)
+
+	l.Infoln("admin api running...")
+	err := http.ListenAndServe(cfg.Listen, adminAuth(cfg.Token, mux))
+	if err != nil {
+		l.WithError(err).Fatalln("listen failed")
+	}
+}
+
+func adminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			adminWriteJson(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminWriteJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// adminMethod checks the method, and returns the id in path if prefix is not empty
+func adminMethod(w http.ResponseWriter, r *http.Request, method string, prefix string) (string, bool) {
+	if r.Method != method {
+		adminWriteJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return "", false
+	}
+	if prefix == "" {
+		return "", true
+	}
+	id := strings.TrimPrefix(r.URL.Path, prefix)
+	if id == "" || strings.Contains(id, "/") {
+		adminWriteJson(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return "", false
+	}
+	return id, true
+}
+
+func adminListServers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminMethod(w, r, http.MethodGet, ""); !ok {
+		return
+	}
+
+	result := make([]*adminServer, 0)
+	serverMapLock.RLock()
+	portKeyMapLock.RLock()
+	for _, v := range serverMap {
+		keys := make([]string, 0, len(v.PortKeys))
+		for k := range v.PortKeys {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		result = append(result, &adminServer{
+			Id:          v.Id,
+			Name:        v.Name,
+			RemoteAddr:  v.Conn.RemoteAddr().String(),
+			ConnectedAt: v.ConnectedAt,
+			Mux:         v.Session != nil,
+			PortKeys:    keys,
+			Sessions:    atomic.LoadInt64(&v.Active),
+			Version:     int(v.Version),
+		})
+	}
+	portKeyMapLock.RUnlock()
+	serverMapLock.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ConnectedAt.Before(result[j].ConnectedAt)
+	})
+	adminWriteJson(w, http.StatusOK, result)
+}
+
+func adminKickServer(w http.ResponseWriter, r *http.Request) {
+	id, ok := adminMethod(w, r, http.MethodDelete, "/servers/")
+	if !ok {
+		return
+	}
+
+	serverMapLock.RLock()
+	thisServer, exist := serverMap[id]
+	serverMapLock.RUnlock()
+	if !exist {
+		adminWriteJson(w, http.StatusNotFound, map[string]string{"error": "server not found"})
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"server_id":   id,
+		"server_name": thisServer.Name,
+	}).Infoln("server kicked by admin")
+	thisServer.Close()
+	adminWriteJson(w, http.StatusOK, map[string]string{})
+}
+
+func adminRevokePortKey(w http.ResponseWriter, r *http.Request) {
+	portKey, ok := adminMethod(w, r, http.MethodDelete, "/port_keys/")
+	if !ok {
+		return
+	}
+
+	portKeyMapLock.Lock()
+	exist := masterRemovePortKey(portKey)
+	portKeyMapLock.Unlock()
+	if !exist {
+		adminWriteJson(w, http.StatusNotFound, map[string]string{"error": "port key not registered"})
+		return
+	}
+
+	sessionMapLock.RLock()
+	for _, v := range sessionMap {
+		if v.PortKey == portKey {
+			v.Close()
+		}
+	}
+	sessionMapLock.RUnlock()
+
+	log.WithFields(log.Fields{
+		"port_key": portKey,
+	}).Infoln("port key revoked by admin")
+	adminWriteJson(w, http.StatusOK, map[string]string{})
+}
+
+func adminListSessions(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminMethod(w, r, http.MethodGet, ""); !ok {
+		return
+	}
+
+	now := time.Now()
+	result := make([]*adminSession, 0)
+	sessionMapLock.RLock()
+	for _, v := range sessionMap {
+		result = append(result, &adminSession{
+			Id:         v.Id,
+			PortKey:    v.PortKey,
+			ServerName: v.ServerName,
+			ClientAddr: v.ClientAddr,
+			StartedAt:  v.StartedAt,
+			Duration:   now.Sub(v.StartedAt).Seconds(),
+			Upload:     atomic.LoadInt64(&v.Upload),
+			Download:   atomic.LoadInt64(&v.Download),
+		})
+	}
+	sessionMapLock.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.Before(result[j].StartedAt)
+	})
+	adminWriteJson(w, http.StatusOK, result)
+}
+
+func adminCloseSession(w http.ResponseWriter, r *http.Request) {
+	id, ok := adminMethod(w, r, http.MethodDelete, "/sessions/")
+	if !ok {
+		return
+	}
+
+	sessionMapLock.RLock()
+	thisSession, exist := sessionMap[id]
+	sessionMapLock.RUnlock()
+	if !exist {
+		adminWriteJson(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+		return
+	}
+
+	thisSession.Close()
+	adminWriteJson(w, http.StatusOK, map[string]string{})
+}
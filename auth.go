@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"golang.org/x/crypto/argon2"
+	"sync"
+)
+
+const AuthNonceSize = 32
+
+// stretching the key is slow on purpose, so it is done once per key and salt
+var authKeyCache = make(map[string][]byte)
+var authKeyCacheLock sync.Mutex
+
+// authKey stretches the key with the salt of master, so that every guess of the key
+// against a recorded proof costs as much as an argon2 run
+func authKey(key string, salt string) []byte {
+	authKeyCacheLock.Lock()
+	defer authKeyCacheLock.Unlock()
+
+	cacheKey := salt + "\x00" + key
+	k, ok := authKeyCache[cacheKey]
+	if !ok {
+		k = argon2.IDKey([]byte(key), []byte("crab auth "+salt), 1, 64*1024, 4, 32)
+		authKeyCache[cacheKey] = k
+	}
+	return k
+}
+
+// authProof proves to the peer that we know the key without sending it,
+// role keeps a proof of one side from being reflected as the proof of the other side
+func authProof(key string, salt string, role string, nonces ...[]byte) []byte {
+	h := hmac.New(sha256.New, authKey(key, salt))
+	h.Write([]byte(role))
+	for _, v := range nonces {
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+func newAuthNonce() ([]byte, error) {
+	nonce := make([]byte, AuthNonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
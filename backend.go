@@ -0,0 +1,167 @@
+package main
+
+import (
+	"github.com/crabkun/crab/config"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type backend struct {
+	// bridges being relayed, keep it first for atomic alignment
+	Active int64
+	// 1 if the last dial or health check failed
+	down int32
+	Addr string
+}
+
+func (b *backend) IsDown() bool {
+	return atomic.LoadInt32(&b.down) == 1
+}
+
+func (b *backend) setDown(down bool) bool {
+	v := int32(0)
+	if down {
+		v = 1
+	}
+	return atomic.SwapInt32(&b.down, v) != v
+}
+
+// backendPool is the local addresses of a port, dead ones are skipped until a health check passes
+type backendPool struct {
+	// for round robin, keep it first for atomic alignment
+	next     uint64
+	cfg      *config.PortConfig
+	backends []*backend
+	stop     chan struct{}
+}
+
+func newBackendPool(cfg *config.PortConfig) *backendPool {
+	p := &backendPool{
+		cfg:  cfg,
+		stop: make(chan struct{}),
+	}
+	for _, v := range cfg.Backends() {
+		p.backends = append(p.backends, &backend{Addr: v})
+	}
+	// health check needs a connection, which udp has not
+	if len(p.backends) > 1 && cfg.Protocol == config.ProtocolTCP {
+		go p.healthCheck()
+	}
+	return p
+}
+
+// sameAs tells whether the pool can be kept for the reloaded port
+func (p *backendPool) sameAs(cfg *config.PortConfig) bool {
+	return p.cfg.Protocol == cfg.Protocol && p.cfg.Balance == cfg.Balance &&
+		p.cfg.HealthCheckInterval == cfg.HealthCheckInterval && reflect.DeepEqual(p.cfg.Backends(), cfg.Backends())
+}
+
+func (p *backendPool) Close() {
+	close(p.stop)
+}
+
+// the master waits 10s for the server to accept a client, so the backends are dialed within
+// a budget below it, each with a shorter timeout
+const BackendDialTimeout = time.Second * 3
+const BackendDialBudget = time.Second * 7
+
+// pick orders the backends by the balance strategy, dead ones are left out unless all are dead
+func (p *backendPool) pick() []*backend {
+	if len(p.backends) == 1 {
+		return p.backends
+	}
+
+	result := make([]*backend, 0, len(p.backends))
+	switch p.cfg.Balance {
+	case config.LoadBalanceLeastConnections:
+		result = append(result, p.backends...)
+		sort.SliceStable(result, func(i, j int) bool {
+			return atomic.LoadInt64(&result[i].Active) < atomic.LoadInt64(&result[j].Active)
+		})
+	case config.LoadBalanceRandom:
+		for _, i := range rand.Perm(len(p.backends)) {
+			result = append(result, p.backends[i])
+		}
+	default:
+		start := int(atomic.AddUint64(&p.next, 1) % uint64(len(p.backends)))
+		result = append(result, p.backends[start:]...)
+		result = append(result, p.backends[:start]...)
+	}
+
+	alive := result[:0:0]
+	for _, v := range result {
+		if !v.IsDown() {
+			alive = append(alive, v)
+		}
+	}
+	if len(alive) != 0 {
+		return alive
+	}
+	// all dead, tried anyway in case the health check is out of date
+	return result
+}
+
+// Dial connects the first backend that works, the backend is returned to count the bridge on it
+func (p *backendPool) Dial() (net.Conn, *backend, error) {
+	var lastErr error
+	deadline := time.Now().Add(BackendDialBudget)
+	for _, v := range p.pick() {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			break
+		}
+		if timeout > BackendDialTimeout {
+			timeout = BackendDialTimeout
+		}
+		conn, err := net.DialTimeout(p.cfg.Protocol, v.Addr, timeout)
+		if err != nil {
+			lastErr = err
+			if len(p.backends) > 1 && v.setDown(true) {
+				log.WithFields(log.Fields{
+					"port_mark":  p.cfg.Mark,
+					"local_addr": v.Addr,
+				}).WithError(err).Warnln("backend is down")
+			}
+			continue
+		}
+		return conn, v, nil
+	}
+	return nil, nil, lastErr
+}
+
+func (p *backendPool) healthCheck() {
+	ticker := time.NewTicker(time.Second * time.Duration(p.cfg.HealthCheckInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, v := range p.backends {
+			conn, err := net.DialTimeout("tcp", v.Addr, time.Second*3)
+			if err == nil {
+				conn.Close()
+			}
+			if !v.setDown(err != nil) {
+				continue
+			}
+			l := log.WithFields(log.Fields{
+				"port_mark":  p.cfg.Mark,
+				"local_addr": v.Addr,
+			})
+			if err != nil {
+				l.WithError(err).Warnln("backend is down")
+			} else {
+				l.Infoln("backend is up")
+			}
+		}
+	}
+}
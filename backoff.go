@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	ServerReconnectMinDelay = time.Second
+	ServerReconnectMaxDelay = time.Minute
+	// a connection lasting this long resets the backoff
+	ServerReconnectResetAfter = time.Second * 30
+)
+
+// backoff is a capped exponential backoff with jitter, the delay doubles after every failure
+// and a random half of it is cut so that peers failed at the same time retry at different times
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt uint
+	rand    *rand.Rand
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{
+		min:  min,
+		max:  max,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (b *backoff) Next() time.Duration {
+	d := b.min << b.attempt
+	if d > b.max || d <= 0 {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	return d/2 + time.Duration(b.rand.Int63n(int64(d/2)+1))
+}
+
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
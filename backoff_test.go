@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, time.Second*10)
+
+	// the delay before the jitter cut of every attempt
+	tests := []time.Duration{
+		time.Second,
+		time.Second * 2,
+		time.Second * 4,
+		time.Second * 8,
+		time.Second * 10,
+		time.Second * 10,
+	}
+	for round := 0; round < 2; round++ {
+		for i, d := range tests {
+			next := b.Next()
+			if next < d/2 || next > d {
+				t.Fatalf("attempt %d delays %s, not in [%s, %s]", i, next, d/2, d)
+			}
+		}
+		b.Reset()
+	}
+}
+
+func TestBackoffOverflow(t *testing.T) {
+	b := newBackoff(time.Second, time.Duration(1<<62))
+	for i := 0; i < 100; i++ {
+		if next := b.Next(); next <= 0 {
+			t.Fatalf("attempt %d delays %s", i, next)
+		}
+	}
+}
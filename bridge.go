@@ -1,22 +1,282 @@
 package main
 
 import (
+	"fmt"
+	"github.com/hashicorp/yamux"
 	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const TcpBridgeBufferSize = 4096
+const DefaultRelayBufferSize = 32 << 10
 
-func tcpBridge(a io.ReadCloser, b io.WriteCloser) {
-	defer func() {
-		a.Close()
-		b.Close()
-	}()
-	buf := make([]byte, TcpBridgeBufferSize)
+// relays from or to a mux stream read from the buffered window of the stream, which takes
+// fewer and larger copies than a socket, so their buffers are never smaller than this
+const MinMuxRelayBufferSize = 64 << 10
+
+// bytes spliced between two counts, so that traffic counters and quotas stay close to real time
+const RelaySpliceChunkSize = 1 << 20
+
+// after a direction of a bridge ended, the other one is cut if it reads nothing for so long,
+// so that a side which never ends its half can't hold the bridge forever
+var RelayHalfCloseIdleTimeout = time.Minute * 5
+
+var relayBufferSize = DefaultRelayBufferSize
+
+var relayMuxBufferSize = MinMuxRelayBufferSize
+
+var relayBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+var relayMuxBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, relayMuxBufferSize)
+		return &buf
+	},
+}
+
+// SetRelayBufferSize must be called before any relay
+func SetRelayBufferSize(size int) {
+	relayBufferSize = size
+	relayMuxBufferSize = MinMuxRelayBufferSize
+	if size > relayMuxBufferSize {
+		relayMuxBufferSize = size
+	}
+}
+
+// relayCounter is called after bytes are relayed, an error cuts the relay
+type relayCounter func(n int) error
+
+// RelayResult tells how many bytes a direction of a bridge relayed and why it ended
+type RelayResult struct {
+	Bytes int64
+	// nil if the source ended normally
+	Err error
+}
+
+func (r RelayResult) Cause() string {
+	if r.Err == nil {
+		return "eof"
+	}
+	return r.Err.Error()
+}
+
+type relayError struct {
+	Op  string
+	Err error
+}
+
+func (e *relayError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Err)
+}
+
+// relayIdle times out the reads of a source once armed, every read pushes the deadline further
+type relayIdle struct {
+	src   interface{ SetReadDeadline(time.Time) error }
+	armed int32
+}
+
+func newRelayIdle(src io.Reader) *relayIdle {
+	d, ok := src.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return nil
+	}
+	return &relayIdle{src: d}
+}
+
+func (i *relayIdle) arm() {
+	if i != nil {
+		atomic.StoreInt32(&i.armed, 1)
+		i.extend()
+	}
+}
+
+func (i *relayIdle) extend() {
+	if i != nil && atomic.LoadInt32(&i.armed) == 1 {
+		i.src.SetReadDeadline(time.Now().Add(RelayHalfCloseIdleTimeout))
+	}
+}
+
+// relayReader and relayWriter keep the errors apart, which io.CopyBuffer returns as one
+type relayReader struct {
+	r    io.Reader
+	idle *relayIdle
+	err  error
+}
+
+func (r *relayReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	if n > 0 {
+		r.idle.extend()
+	}
+	if err != nil && err != io.EOF {
+		r.err = &relayError{Op: "read", Err: err}
+	}
+	return n, err
+}
+
+type relayWriter struct {
+	w     io.Writer
+	count relayCounter
+	err   error
+}
+
+func (w *relayWriter) Write(buf []byte) (int, error) {
+	n, err := w.w.Write(buf)
+	if err != nil {
+		w.err = &relayError{Op: "write", Err: err}
+		return n, err
+	}
+	if w.count != nil && n > 0 {
+		if err = w.count(n); err != nil {
+			w.err = err
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// relay copies src to dst until src ends or either side fails, count may be nil
+func relay(dst io.Writer, src io.Reader, count relayCounter) RelayResult {
+	return relayWithIdle(dst, src, count, nil)
+}
+
+// relayWithIdle is relay which times out after idle is armed, idle may be nil
+func relayWithIdle(dst io.Writer, src io.Reader, count relayCounter, idle *relayIdle) RelayResult {
+	if dstConn, srcConn, ok := spliceable(dst, src); ok {
+		return relaySplice(dstConn, srcConn, count, idle)
+	}
+
+	pool := &relayBufferPool
+	if isMuxStream(dst) || isMuxStream(src) {
+		pool = &relayMuxBufferPool
+	}
+	bufp := pool.Get().(*[]byte)
+	defer pool.Put(bufp)
+
+	r := &relayReader{r: src, idle: idle}
+	w := &relayWriter{w: dst, count: count}
+	n, err := io.CopyBuffer(w, r, *bufp)
+
+	result := RelayResult{Bytes: n}
+	switch {
+	case w.err != nil:
+		result.Err = w.err
+	case r.err != nil:
+		result.Err = r.err
+	default:
+		result.Err = err
+	}
+	return result
+}
+
+func isMuxStream(v interface{}) bool {
+	_, ok := v.(*yamux.Stream)
+	return ok
+}
+
+// spliceable tells whether both sides are plain tcp connections, which the master relays only for
+// callbacks of servers and clients of older versions without tls, newer ones always use mux.
+// it never decrypts so the bytes need not enter user space
+func spliceable(dst io.Writer, src io.Reader) (*net.TCPConn, *net.TCPConn, bool) {
+	dstConn, ok := dst.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	srcConn, ok := src.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	return dstConn, srcConn, true
+}
+
+// relaySplice relays by (*net.TCPConn).ReadFrom, which is splice(2) on linux
+func relaySplice(dst *net.TCPConn, src *net.TCPConn, count relayCounter, idle *relayIdle) RelayResult {
+	var result RelayResult
 	for {
-		n, err := a.Read(buf)
+		n, err := io.CopyBuffer(dst, &io.LimitedReader{R: src, N: RelaySpliceChunkSize}, nil)
+		result.Bytes += n
+		if n > 0 && count != nil {
+			if cerr := count(int(n)); cerr != nil {
+				result.Err = cerr
+				return result
+			}
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && n > 0 {
+			// the chunk timed out but was not idle
+			idle.extend()
+			continue
+		}
 		if err != nil {
-			return
+			result.Err = err
+			return result
+		}
+		if n < RelaySpliceChunkSize {
+			return result
 		}
-		b.Write(buf[:n])
 	}
 }
+
+// closeWrite shuts down the writing side of w only, so the peer reads eof but can still write back.
+// yamux streams are half closed by Close, anything else without CloseWrite is closed entirely
+func closeWrite(w io.Closer) error {
+	switch c := w.(type) {
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite()
+	case *yamux.Stream:
+		return c.Close()
+	}
+	return w.Close()
+}
+
+// relayPair relays a to b and c to d at the same time. a direction ending normally only half closes
+// its destination, so the other direction keeps flowing until it ends too or idles for
+// RelayHalfCloseIdleTimeout, while a failed direction cuts both. done is called with the results
+// of both after they finished
+func relayPair(a io.ReadCloser, b io.WriteCloser, c io.ReadCloser, d io.WriteCloser,
+	countAB, countCD relayCounter, done func(ab, cd RelayResult)) {
+	var ab, cd RelayResult
+	var closeOnce sync.Once
+	closeAll := func() {
+		closeOnce.Do(func() {
+			a.Close()
+			b.Close()
+			c.Close()
+			d.Close()
+		})
+	}
+
+	idleA, idleC := newRelayIdle(a), newRelayIdle(c)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ab = relayWithIdle(b, a, countAB, idleA)
+		if ab.Err != nil || closeWrite(b) != nil {
+			closeAll()
+			return
+		}
+		idleC.arm()
+	}()
+	go func() {
+		defer wg.Done()
+		cd = relayWithIdle(d, c, countCD, idleC)
+		if cd.Err != nil || closeWrite(d) != nil {
+			closeAll()
+			return
+		}
+		idleA.arm()
+	}()
+	go func() {
+		wg.Wait()
+		closeAll()
+		done(ab, cd)
+	}()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/hashicorp/yamux"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback tcp connection
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			tb.Error(err)
+		}
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c, <-accepted
+}
+
+// muxPair returns both ends of a stream of a mux session over loopback tcp
+func muxPair(tb testing.TB) (net.Conn, net.Conn) {
+	a, b := tcpPair(tb)
+	client, err := yamux.Client(a, newMuxConfig())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server, err := yamux.Server(b, newMuxConfig())
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn)
+	go func() {
+		s, err := server.Accept()
+		if err != nil {
+			tb.Error(err)
+		}
+		accepted <- s
+	}()
+	s, err := client.Open()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	// the stream is announced by its first write
+	s.Write([]byte{0})
+	peer := <-accepted
+	io.ReadFull(peer, make([]byte, 1))
+	return s, peer
+}
+
+// benchmarkRelay measures the master relaying a client to a server, both connected by pair
+func benchmarkRelay(b *testing.B, pair func(testing.TB) (net.Conn, net.Conn)) {
+	client, fromClient := pair(b)
+	toServer, server := pair(b)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relay(toServer, fromClient, nil)
+		closeWrite(toServer)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(ioutil.Discard, server)
+	}()
+
+	chunk := make([]byte, 32<<10)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := client.Write(chunk)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	closeWrite(client)
+	wg.Wait()
+	b.StopTimer()
+
+	for _, v := range []net.Conn{client, fromClient, toServer, server} {
+		v.Close()
+	}
+}
+
+// plain tcp connections are spliced on linux
+func BenchmarkRelayTCP(b *testing.B) {
+	benchmarkRelay(b, tcpPair)
+}
+
+// mux streams are copied through a buffer, of MinMuxRelayBufferSize unless set larger
+func BenchmarkRelayMux(b *testing.B) {
+	defer SetRelayBufferSize(DefaultRelayBufferSize)
+	for _, size := range []int{32 << 10, 64 << 10, 128 << 10, 256 << 10} {
+		b.Run(strconv.Itoa(size>>10)+"k", func(b *testing.B) {
+			relayMuxBufferSize = size
+			relayMuxBufferPool = sync.Pool{New: relayMuxBufferPool.New}
+			benchmarkRelay(b, muxPair)
+		})
+	}
+}
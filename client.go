@@ -1,53 +1,335 @@
 package main
 
 import (
-	"github.com/crabkun/crab/compress"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/crabkun/crab/config"
-	"github.com/crabkun/crab/crypto"
+	"github.com/hashicorp/yamux"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var clientConfig *config.ClientConfig
+var clientTLSConfig *tls.Config
+
+// every connection accepted by any port is carried by a stream of these sessions
+var clientSessions []*clientSession
+var clientSessionsNext int
+var clientSessionsLock sync.Mutex
+
+type clientSession struct {
+	session *yamux.Session
+	// the connect in flight, nil if none
+	dial *clientDial
+}
+
+// set once master turns out to be of an older version, every connection is carried by its own
+// connection to master from then on
+var clientLegacyMaster int32
+
+var errLegacyMaster = errors.New("master is of an older version without multiplexing")
+
+// the salt of port key ids of master, empty for masters of older versions
+var clientMasterSalt atomic.Value
+
+// clientDial is a connect to master, the connections waiting for it share its result
+type clientDial struct {
+	done    chan struct{}
+	session *yamux.Session
+	err     error
+}
 
 func ClientMain(cfg *config.ClientConfig) {
 	clientConfig = cfg
+	clientSessions = make([]*clientSession, cfg.MuxSessions)
+	for i := range clientSessions {
+		clientSessions[i] = &clientSession{}
+	}
+	clientPortMap = make(map[string]*clientPort)
+
+	if cfg.TLS != nil {
+		var err error
+		clientTLSConfig, err = cfg.TLS.DialTLSConfig()
+		if err != nil {
+			log.WithError(err).Fatalln("load tls config failed")
+		}
+	}
 
 	for i := range cfg.Ports {
-		go clientListenAt(cfg.Ports[i])
+		err := clientStartPort(cfg.Ports[i])
+		if err != nil {
+			log.WithFields(log.Fields{
+				"port_mark": cfg.Ports[i].Mark,
+				"listen_at": cfg.Ports[i].LocalAddress,
+			}).WithError(err).Fatalln("listen failed")
+		}
 	}
 
+	watchReload(clientReload)
+
 	select {}
 }
 
-func clientListenAt(cfg *config.PortConfig) {
+// clientPort is a running listener, the config of it can be replaced by reloading
+// and the new one takes effect on new connections
+type clientPort struct {
+	cfg    atomic.Value
+	closer io.Closer
+	closed int32
+}
+
+func (p *clientPort) Config() *config.PortConfig {
+	return p.cfg.Load().(*config.PortConfig)
+}
+
+func (p *clientPort) Close() error {
+	atomic.StoreInt32(&p.closed, 1)
+	return p.closer.Close()
+}
+
+func (p *clientPort) IsClosed() bool {
+	return atomic.LoadInt32(&p.closed) == 1
+}
+
+// running listeners, by protocol and listen address
+var clientPortMap map[string]*clientPort
+var clientPortMapLock sync.Mutex
+
+func clientPortName(cfg *config.PortConfig) string {
+	return cfg.Protocol + "/" + cfg.LocalAddress
+}
+
+func clientStartPort(cfg *config.PortConfig) error {
+	p := &clientPort{}
+	p.cfg.Store(cfg)
+
+	if cfg.Protocol == config.ProtocolUDP {
+		conn, err := net.ListenPacket("udp", cfg.LocalAddress)
+		if err != nil {
+			return err
+		}
+		p.closer = conn
+		go clientListenUdp(p, conn)
+	} else {
+		listener, err := net.Listen("tcp", cfg.LocalAddress)
+		if err != nil {
+			return err
+		}
+		p.closer = listener
+		go clientListenAt(p, listener)
+	}
+
+	clientPortMapLock.Lock()
+	clientPortMap[clientPortName(cfg)] = p
+	clientPortMapLock.Unlock()
+	return nil
+}
+
+// clientReload reloads the ports from the config file, listeners of new ports are started and
+// those of removed ones are stopped, established connections are kept
+func clientReload() {
 	l := log.WithFields(log.Fields{
-		"port_mark": cfg.Mark,
-		"listen_at": cfg.LocalAddress,
+		"file": ConfigFile,
 	})
 
-	listener, err := net.Listen("tcp", cfg.LocalAddress)
+	var cfg *config.ClientConfig
+	err := loadConfig(&cfg)
+	if err != nil {
+		l.WithError(err).Errorln("reload configure file failed")
+		return
+	}
+	err = cfg.Validate()
 	if err != nil {
-		l.WithError(err).Fatalln("listen failed")
+		l.WithError(err).Errorln("validate reloaded configure file failed")
+		return
+	}
+	if cfg.Master != clientConfig.Master || cfg.MuxSessions != clientConfig.MuxSessions ||
+		!reflect.DeepEqual(cfg.TLS, clientConfig.TLS) || cfg.AllowLegacyMaster != clientConfig.AllowLegacyMaster {
+		l.Warnln("only ports are reloaded, restart to apply the changes of master, mux_sessions, tls or allow_legacy_master")
+	}
+
+	newPorts := make(map[string]*config.PortConfig)
+	for _, v := range cfg.Ports {
+		newPorts[clientPortName(v)] = v
+	}
+
+	clientPortMapLock.Lock()
+	var stopped []*clientPort
+	for name, p := range clientPortMap {
+		if _, exist := newPorts[name]; !exist {
+			delete(clientPortMap, name)
+			stopped = append(stopped, p)
+		}
+	}
+	var started []*config.PortConfig
+	for name, v := range newPorts {
+		p, exist := clientPortMap[name]
+		if exist {
+			p.cfg.Store(v)
+			continue
+		}
+		started = append(started, v)
+	}
+	clientPortMapLock.Unlock()
+
+	for _, p := range stopped {
+		p.Close()
+		l.WithFields(log.Fields{
+			"port_mark": p.Config().Mark,
+			"listen_at": p.Config().LocalAddress,
+		}).Infoln("port stopped")
 	}
+	for _, v := range started {
+		err = clientStartPort(v)
+		if err != nil {
+			l.WithFields(log.Fields{
+				"port_mark": v.Mark,
+				"listen_at": v.LocalAddress,
+			}).WithError(err).Errorln("listen failed")
+		}
+	}
+
+	l.Infoln("configure file reloaded")
+}
+
+func clientListenAt(p *clientPort, listener net.Listener) {
+	cfg := p.Config()
+	l := log.WithFields(log.Fields{
+		"port_mark": cfg.Mark,
+		"listen_at": cfg.LocalAddress,
+	})
 
 	l.Infoln("port running...")
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if p.IsClosed() {
+				return
+			}
 			l.WithError(err).Errorln("accept new connection failed, retrying in 1s")
 			time.Sleep(time.Second * 1)
 			continue
 		}
 
-		go clientHandleNewConn(conn, cfg)
+		go clientHandleNewConn(conn, p.Config())
+	}
+}
+
+// clientOpenStream opens a stream to master, picking the sessions in turn
+// and (re)connecting the picked one if it is not established yet or closed.
+// the connect is done without the lock, so that other sessions are not blocked by it
+func clientOpenStream() (net.Conn, error) {
+	if atomic.LoadInt32(&clientLegacyMaster) == 1 {
+		return dialMaster(clientConfig.Master, clientTLSConfig)
+	}
+
+	clientSessionsLock.Lock()
+	s := clientSessions[clientSessionsNext]
+	clientSessionsNext = (clientSessionsNext + 1) % len(clientSessions)
+
+	if s.session != nil && !s.session.IsClosed() {
+		session := s.session
+		clientSessionsLock.Unlock()
+		return session.Open()
+	}
+
+	d := s.dial
+	if d == nil {
+		d = &clientDial{
+			done: make(chan struct{}),
+		}
+		s.dial = d
+		clientSessionsLock.Unlock()
+
+		d.session, d.err = clientConnectMaster()
+
+		clientSessionsLock.Lock()
+		s.dial = nil
+		if d.err == nil {
+			s.session = d.session
+		}
+		close(d.done)
+	}
+	clientSessionsLock.Unlock()
+
+	<-d.done
+	if d.err == errLegacyMaster {
+		return dialMaster(clientConfig.Master, clientTLSConfig)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.session.Open()
+}
+
+func clientConnectMaster() (*yamux.Session, error) {
+	c, h, err := dialMasterHello(clientConfig.Master, clientTLSConfig, clientConfig.AllowLegacyMaster)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version == 0 {
+		c.Close()
+		atomic.StoreInt32(&clientLegacyMaster, 1)
+		clientMasterSalt.Store("")
+		return nil, errLegacyMaster
+	}
+	if !h.Has(CapabilityMux) {
+		c.Close()
+		return nil, fmt.Errorf("master does not support multiplexing, please upgrade master")
+	}
+	if h.Salt == "" {
+		c.Close()
+		return nil, fmt.Errorf("master sent no port key salt")
+	}
+	clientMasterSalt.Store(h.Salt)
+
+	err = SendCommand(c, CommandClientMuxHandshake, nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	buf, err := ReadHandshakeFromSocket(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if buf[0] != ResponseCodeReady {
+		c.Close()
+		return nil, fmt.Errorf("master response an unsupported code %d", buf[0])
+	}
+
+	c.SetDeadline(time.Time{})
+
+	session, err := yamux.Client(c, newMuxConfig())
+	if err != nil {
+		c.Close()
+		return nil, err
 	}
+
+	log.WithFields(log.Fields{
+		"master": clientConfig.Master,
+	}).Debugln("mux session established")
+	return session, nil
 }
 
 func clientHandleNewConn(remote net.Conn, cfg *config.PortConfig) {
+	switch cfg.Protocol {
+	case config.ProtocolSocks5:
+		clientHandleSocks5(remote, cfg)
+		return
+	case config.ProtocolHttpProxy:
+		clientHandleHttpProxy(remote, cfg)
+		return
+	}
+
 	l := log.WithFields(log.Fields{
 		"port_mark":   cfg.Mark,
 		"listen_at":   cfg.LocalAddress,
@@ -58,91 +340,84 @@ func clientHandleNewConn(remote net.Conn, cfg *config.PortConfig) {
 		"remote_addr": remote.RemoteAddr(),
 	}).Debugln("new connection coming")
 
-	var err error
-	ok := false
-	defer func() {
-		if !ok {
-			remote.Close()
-		}
-	}()
+	master, ok := clientMatchServer(cfg, l)
+	if !ok {
+		remote.Close()
+		return
+	}
+
+	masterToRemote, remoteToMaster, err := wrapTunnel(cfg, master)
+	if err != nil {
+		l.WithError(err).Errorln("init tunnel failed")
+		remote.Close()
+		master.Close()
+		return
+	}
+
+	clientActiveConnections.Inc()
+
+	relayPair(remote, remoteToMaster, masterToRemote, remote, nil, nil, func(up, down RelayResult) {
+		clientActiveConnections.Dec()
+		l.WithFields(log.Fields{
+			"upload":       up.Bytes,
+			"download":     down.Bytes,
+			"upload_end":   up.Cause(),
+			"download_end": down.Cause(),
+		}).Debugln("connection closed")
+	})
+}
 
+// clientMatchServer opens a stream to master and handshakes with the port key,
+// the stream is returned after the server accepted it
+func clientMatchServer(cfg *config.PortConfig, l *log.Entry) (net.Conn, bool) {
 	l = l.WithFields(log.Fields{
 		"master": clientConfig.Master,
 	})
 
-	master, err := net.Dial("tcp", clientConfig.Master)
+	master, err := clientOpenStream()
 	if err != nil {
-		l.WithError(err).Errorln("dial master failed")
-		return
+		l.WithError(err).Errorln("open stream to master failed")
+		return nil, false
 	}
 
+	ok := false
 	defer func() {
 		if !ok {
 			master.Close()
 		}
 	}()
 
-	// handshake and match port key
-	SendCommand(master, CommandClientHandshake, []byte(cfg.PortKey))
+	// handshake and match port key, masters of older versions have no salt and know the port key only
+	salt, _ := clientMasterSalt.Load().(string)
+	SendCommand(master, CommandClientHandshake, []byte(cfg.PortKeyId(salt)))
 
 	for {
-		buf, err := ReadFromSocket(master)
+		buf, err := ReadHandshakeFromSocket(master)
 		if err != nil {
 			if err != io.EOF {
 				l.WithError(err).Errorln("read from master failed")
 			} else {
 				l.Errorln("master disconnected connection")
 			}
-			return
+			return nil, false
 		}
 
 		// get the resp code
 		code := buf[0]
 		buf = buf[1:]
 
+		if code != ResponseCodeServerAcceptClient {
+			clientHandshakeFailures.WithLabelValues(strconv.Itoa(int(code))).Inc()
+		}
+
 		switch code {
 		case ResponseCodeServerAcceptClient:
-			er, ew, err := crypto.GetCrypto(cfg.EncryptMethod)
-			if err != nil {
-				// checked while validate configure
-				panic(err)
-			}
-			cr, cw, err := compress.GetCompress(cfg.CompressMethod)
-			if err != nil {
-				panic(err)
-			}
-
-			remoteToMaster, err := ew(cfg.PortKey, master)
-			if err != nil {
-				l.WithError(err).Errorln("init encrypt failed")
-				return
-			}
-			remoteToMaster, err = cw(remoteToMaster)
-			if err != nil {
-				l.WithError(err).Errorln("init compress failed")
-				return
-			}
-
-			masterToRemote, err := er(cfg.PortKey, master)
-			if err != nil {
-				l.WithError(err).Errorln("init decrypt failed")
-				return
-			}
-			masterToRemote, err = cr(masterToRemote)
-			if err != nil {
-				l.WithError(err).Errorln("init decompress failed")
-				return
-			}
-
 			l.Debugln("client match server success")
 			ok = true
-			// tcp bridge
-			go tcpBridge(remote, remoteToMaster)
-			go tcpBridge(masterToRemote, remote)
-			return
+			return master, true
 		case ResponseCodeServerRejectClient:
 			if len(buf) == 0 {
-				return
+				return nil, false
 			}
 			// reject reason
 			switch buf[0] {
@@ -157,13 +432,149 @@ func clientHandleNewConn(remote net.Conn, cfg *config.PortConfig) {
 			l.WithFields(log.Fields{
 				"port_key": cfg.PortKey,
 			}).Errorln("master reported that the port key is not registered at master")
+		case ResponseCodePortKeyConnectDenied:
+			l.WithFields(log.Fields{
+				"port_key": cfg.PortKey,
+			}).Errorln("master reported that this client is not allowed to connect to the port key")
+		case ResponseCodeQuotaExceeded:
+			l.WithFields(log.Fields{
+				"port_key": cfg.PortKey,
+			}).Errorln("master reported that the traffic quota of the port key or its server is used up")
 		case ResponseCodePortKeyConnectTimeout:
 			l.Errorln("master reported that connect to server timeout")
 		default:
 			l.WithFields(log.Fields{
 				"code": int(code),
 			}).Errorln("master response an unsupported code")
+			return nil, false
+		}
+	}
+}
+
+type clientUdpSession struct {
+	// unix nano of the last datagram in either direction, keep it first for atomic alignment
+	LastActive int64
+	Addr       net.Addr
+	C          chan []byte
+}
+
+func clientListenUdp(p *clientPort, conn net.PacketConn) {
+	cfg := p.Config()
+	l := log.WithFields(log.Fields{
+		"port_mark": cfg.Mark,
+		"listen_at": cfg.LocalAddress,
+		"protocol":  cfg.Protocol,
+	})
+
+	l.Infoln("port running...")
+
+	// every source address has its own session and tunnel
+	sessions := make(map[string]*clientUdpSession)
+	var sessionsLock sync.Mutex
+
+	buf := make([]byte, UdpMaxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if p.IsClosed() {
+				return
+			}
+			l.WithError(err).Errorln("read datagram failed, retrying in 1s")
+			time.Sleep(time.Second * 1)
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		sessionsLock.Lock()
+		s, exist := sessions[addr.String()]
+		if !exist {
+			s = &clientUdpSession{
+				Addr:       addr,
+				C:          make(chan []byte, 64),
+				LastActive: time.Now().UnixNano(),
+			}
+			sessions[addr.String()] = s
+
+			go func(cfg *config.PortConfig) {
+				clientHandleUdpSession(conn, s, cfg)
+
+				sessionsLock.Lock()
+				delete(sessions, s.Addr.String())
+				sessionsLock.Unlock()
+			}(p.Config())
+		}
+		sessionsLock.Unlock()
+
+		select {
+		case s.C <- data:
+		default:
+			// the tunnel is not ready or too slow, drop it like a congested link does
+		}
+	}
+}
+
+func clientHandleUdpSession(conn net.PacketConn, s *clientUdpSession, cfg *config.PortConfig) {
+	l := log.WithFields(log.Fields{
+		"port_mark":   cfg.Mark,
+		"listen_at":   cfg.LocalAddress,
+		"protocol":    cfg.Protocol,
+		"remote_addr": s.Addr,
+	})
+
+	l.Debugln("new udp session coming")
+
+	master, ok := clientMatchServer(cfg, l)
+	if !ok {
+		return
+	}
+
+	masterToRemote, remoteToMaster, err := wrapTunnel(cfg, master)
+	if err != nil {
+		l.WithError(err).Errorln("init tunnel failed")
+		master.Close()
+		return
+	}
+	defer func() {
+		masterToRemote.Close()
+		remoteToMaster.Close()
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			data, err := readDatagram(masterToRemote)
+			if err != nil {
+				return
+			}
+			atomic.StoreInt64(&s.LastActive, time.Now().UnixNano())
+			conn.WriteTo(data, s.Addr)
+		}
+	}()
+
+	// one timer for the session, when it fires early because of recent datagrams
+	// it is reset to the time left
+	timeout := time.Second * time.Duration(cfg.UdpTimeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case data := <-s.C:
+			atomic.StoreInt64(&s.LastActive, time.Now().UnixNano())
+			if writeDatagram(remoteToMaster, data) != nil {
+				return
+			}
+		case <-closed:
+			l.Debugln("udp session closed by remote")
 			return
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.LastActive)))
+			if idle >= timeout {
+				l.Debugln("udp session idle timeout")
+				return
+			}
+			timer.Reset(timeout - idle)
 		}
 	}
 }
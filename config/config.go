@@ -1,14 +1,23 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/crabkun/crab/compress"
 	"github.com/crabkun/crab/crypto"
+	"net"
+	"strings"
 )
 
 type BaseConfig struct {
 	Mode     string `json:"mode"`
 	LogLevel string `json:"log_level"`
+	// prometheus metrics are exposed at /metrics of this address if set
+	MetricsListen string `json:"metrics_listen"`
+	// bytes, limits the control packets, 0 for the default
+	MaxPacketSize int `json:"max_packet_size"`
+	// bytes of the buffer of every relay direction, 0 for the default
+	RelayBufferSize int `json:"relay_buffer_size"`
 }
 
 func (c *BaseConfig) Validate() error {
@@ -18,12 +27,161 @@ func (c *BaseConfig) Validate() error {
 	if c.LogLevel == "" {
 		return fmt.Errorf("log level (log_level) empty")
 	}
+	if c.MaxPacketSize != 0 && c.MaxPacketSize < 1024 {
+		return fmt.Errorf("max packet size (max_packet_size) less than 1024")
+	}
+	if c.RelayBufferSize != 0 && c.RelayBufferSize < 1024 {
+		return fmt.Errorf("relay buffer size (relay_buffer_size) less than 1024")
+	}
 	return nil
 }
 
 type MasterConfig struct {
 	ListenAt  string `json:"listen_at"`
 	MasterKey string `json:"master_key"`
+	// port key ids are derived with it, a random one is used if empty
+	PortKeySalt string `json:"port_key_salt"`
+	// accept servers of older versions which send master key in plain text
+	AllowPlainAuth bool                `json:"allow_plain_auth"`
+	TLS            *TLSConfig          `json:"tls"`
+	PortKeyStore   *PortKeyStoreConfig `json:"port_key_store"`
+	RateLimits     []*RateLimitConfig  `json:"rate_limits"`
+	Quotas         []*QuotaConfig      `json:"quotas"`
+	// keeps traffic counters across restarts
+	QuotaStateFile string       `json:"quota_state_file"`
+	Admin          *AdminConfig `json:"admin"`
+	// seconds, a server sending heartbeat is disconnected if nothing received from it in this time
+	HeartbeatTimeout int `json:"heartbeat_timeout"`
+	// addresses of other masters sharing the port key registry, clients are forwarded
+	// to the master which the server of the port key connects to
+	Peers []string `json:"peers"`
+	// masters authenticate each other with it, which servers never know
+	PeerKey string `json:"peer_key"`
+	// empty for a port key registered by one server only,
+	// otherwise several servers can register the same port key and share the clients
+	LoadBalance string `json:"load_balance"`
+
+	// quotas and rate limits by port key id and quotas by server name, built by Index
+	portKeyQuotas map[string]*QuotaConfig
+	serverQuotas  map[string]*QuotaConfig
+	rateLimits    map[string]*RateLimitConfig
+}
+
+// Index derives the port key ids of the quotas and rate limits once, since deriving is slow.
+// it is called after the port key salt is set, the first one of a port key or server is used
+func (c *MasterConfig) Index() {
+	c.portKeyQuotas = make(map[string]*QuotaConfig)
+	c.serverQuotas = make(map[string]*QuotaConfig)
+	for _, v := range c.Quotas {
+		if v.Server != "" {
+			if _, exist := c.serverQuotas[v.Server]; !exist {
+				c.serverQuotas[v.Server] = v
+			}
+			continue
+		}
+		id := v.Id(c.PortKeySalt)
+		if _, exist := c.portKeyQuotas[id]; !exist {
+			c.portKeyQuotas[id] = v
+		}
+	}
+	c.rateLimits = make(map[string]*RateLimitConfig)
+	for _, v := range c.RateLimits {
+		id := v.Id(c.PortKeySalt)
+		if _, exist := c.rateLimits[id]; !exist {
+			c.rateLimits[id] = v
+		}
+	}
+}
+
+const (
+	LoadBalanceRoundRobin       = "round_robin"
+	LoadBalanceLeastConnections = "least_connections"
+	LoadBalanceRandom           = "random"
+)
+
+// AdminConfig enables the admin http api on a separate listener
+type AdminConfig struct {
+	Listen string `json:"listen"`
+	// requests must carry header "Authorization: Bearer <token>"
+	Token string `json:"token"`
+}
+
+// QuotaConfig limits the bytes of both directions relayed for a port key or a server,
+// 0 for unlimited
+type QuotaConfig struct {
+	// either the port key, its id or the server name
+	PortKey   string `json:"port_key"`
+	PortKeyId string `json:"port_key_id"`
+	Server    string `json:"server"`
+
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+func (c *QuotaConfig) Id(salt string) string {
+	if c.PortKey != "" {
+		return crypto.PortKeyId(c.PortKey, salt)
+	}
+	return c.PortKeyId
+}
+
+func (c *MasterConfig) GetPortKeyQuota(portKeyId string) *QuotaConfig {
+	return c.portKeyQuotas[portKeyId]
+}
+
+func (c *MasterConfig) GetServerQuota(server string) *QuotaConfig {
+	return c.serverQuotas[server]
+}
+
+// RateLimitConfig limits the bandwidth of a port key in bytes per second, 0 for unlimited,
+// upload is the traffic from client to server
+type RateLimitConfig struct {
+	// either the port key or its id, not needed in the port key store
+	PortKey   string `json:"port_key" yaml:"port_key"`
+	PortKeyId string `json:"port_key_id" yaml:"port_key_id"`
+	// shared by all connections of the port key
+	Upload   int `json:"upload" yaml:"upload"`
+	Download int `json:"download" yaml:"download"`
+	// of every single connection
+	ConnUpload   int `json:"conn_upload" yaml:"conn_upload"`
+	ConnDownload int `json:"conn_download" yaml:"conn_download"`
+}
+
+func (c *RateLimitConfig) Id(salt string) string {
+	if c.PortKey != "" {
+		return crypto.PortKeyId(c.PortKey, salt)
+	}
+	return c.PortKeyId
+}
+
+func (c *MasterConfig) GetRateLimit(portKeyId string) *RateLimitConfig {
+	return c.rateLimits[portKeyId]
+}
+
+type PortKeyStoreConfig struct {
+	// file, sqlite or http
+	Type string `json:"type"`
+	// file and sqlite only
+	Path string `json:"path"`
+	// http only
+	Url   string `json:"url"`
+	Token string `json:"token"`
+}
+
+func (c *PortKeyStoreConfig) Validate() error {
+	switch strings.ToLower(c.Type) {
+	case "file", "sqlite":
+		if c.Path == "" {
+			return fmt.Errorf("port key store path (port_key_store.path) empty")
+		}
+	case "http":
+		if c.Url == "" {
+			return fmt.Errorf("port key store url (port_key_store.url) empty")
+		}
+	default:
+		return fmt.Errorf("unsupported port key store type %s", c.Type)
+	}
+	return nil
 }
 
 func (c *MasterConfig) Validate() error {
@@ -33,57 +191,283 @@ func (c *MasterConfig) Validate() error {
 	if c.MasterKey == "" {
 		return fmt.Errorf("master key (master_key) empty")
 	}
+	if c.TLS != nil {
+		if err := c.TLS.validate(true); err != nil {
+			return err
+		}
+	}
+	if c.PortKeyStore != nil {
+		if err := c.PortKeyStore.Validate(); err != nil {
+			return err
+		}
+	}
+	for i, v := range c.RateLimits {
+		if v.PortKey == "" && v.PortKeyId == "" {
+			return fmt.Errorf("rate limit (at pos %d) has neither port_key nor port_key_id", i)
+		}
+	}
+	if c.Admin != nil {
+		if c.Admin.Listen == "" {
+			return fmt.Errorf("admin listen address (admin.listen) empty")
+		}
+		if c.Admin.Token == "" {
+			return fmt.Errorf("admin token (admin.token) empty")
+		}
+	}
+	for i, v := range c.Quotas {
+		if (v.PortKey == "" && v.PortKeyId == "") == (v.Server == "") {
+			return fmt.Errorf("quota (at pos %d) must have either port_key, port_key_id or server", i)
+		}
+	}
+	if c.HeartbeatTimeout < 0 {
+		return fmt.Errorf("heartbeat timeout (heartbeat_timeout) negative")
+	}
+	if c.HeartbeatTimeout == 0 {
+		c.HeartbeatTimeout = 60
+	}
+	for i, v := range c.Peers {
+		if v == "" {
+			return fmt.Errorf("peer address (peers at pos %d) empty", i)
+		}
+	}
+	if len(c.Peers) != 0 && c.PeerKey == "" {
+		return fmt.Errorf("peer key (peer_key) empty")
+	}
+	if c.PeerKey != "" && c.PeerKey == c.MasterKey {
+		return fmt.Errorf("peer key (peer_key) must differ from master key (master_key)")
+	}
+	switch c.LoadBalance {
+	case "", LoadBalanceRoundRobin, LoadBalanceLeastConnections, LoadBalanceRandom:
+	default:
+		return fmt.Errorf("unsupported load balance strategy (load_balance) %s", c.LoadBalance)
+	}
+	// ids kept outside of this process must stay the same across restarts and peers
+	stableIds := c.PortKeyStore != nil || c.QuotaStateFile != "" || len(c.Peers) != 0
+	for _, v := range c.RateLimits {
+		stableIds = stableIds || v.PortKeyId != ""
+	}
+	for _, v := range c.Quotas {
+		stableIds = stableIds || v.PortKeyId != ""
+	}
+	if stableIds && c.PortKeySalt == "" {
+		return fmt.Errorf("port key salt (port_key_salt) empty, it is required by port_key_store, quota_state_file, peers and port_key_id")
+	}
+	return nil
+}
+
+// Addresses is either a single address or a list of them
+type Addresses []string
+
+func (a *Addresses) UnmarshalJSON(b []byte) error {
+	var one string
+	if json.Unmarshal(b, &one) == nil {
+		*a = Addresses{one}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(b, &list)
+	if err != nil {
+		return err
+	}
+	*a = list
 	return nil
 }
 
 type ServerConfig struct {
-	Master    string        `json:"master"`
+	// identity of this server at master, used by the port key store of master
+	Name string `json:"name"`
+	// tried in turn when connecting master fails
+	Master    Addresses     `json:"master"`
 	MasterKey string        `json:"master_key"`
+	TLS       *TLSConfig    `json:"tls"`
 	Ports     []*PortConfig `json:"ports"`
+	// seconds, ping master every interval and reconnect if nothing received in timeout
+	HeartbeatInterval int `json:"heartbeat_interval"`
+	HeartbeatTimeout  int `json:"heartbeat_timeout"`
+	// talk to a master of an older version, which takes the master key and the port keys in plain text
+	AllowLegacyMaster bool `json:"allow_legacy_master"`
 }
 
 func (c *ServerConfig) Validate() error {
-	if c.Master == "" {
+	if len(c.Master) == 0 {
 		return fmt.Errorf("master address (master) empty")
 	}
+	for i, v := range c.Master {
+		if v == "" {
+			return fmt.Errorf("master address (master at pos %d) empty", i)
+		}
+	}
 	if c.MasterKey == "" {
 		return fmt.Errorf("master key (master_key) empty")
 	}
+	if c.TLS != nil {
+		if err := c.TLS.validate(false); err != nil {
+			return err
+		}
+	}
 	if len(c.Ports) == 0 {
 		return fmt.Errorf("ports empty")
 	}
+	if c.HeartbeatInterval < 0 {
+		return fmt.Errorf("heartbeat interval (heartbeat_interval) negative")
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = 15
+	}
+	if c.HeartbeatTimeout < 0 {
+		return fmt.Errorf("heartbeat timeout (heartbeat_timeout) negative")
+	}
+	if c.HeartbeatTimeout == 0 {
+		c.HeartbeatTimeout = c.HeartbeatInterval * 3
+	}
+	if c.HeartbeatTimeout <= c.HeartbeatInterval {
+		return fmt.Errorf("heartbeat timeout (heartbeat_timeout) must be greater than heartbeat interval (heartbeat_interval)")
+	}
 
 	for i, v := range c.Ports {
 		pe := v.Validate()
 		if pe != nil {
 			return fmt.Errorf("port (at pos %d) validate failed :%s", i, pe.Error())
 		}
+		if v.Protocol == ProtocolSocks5 || v.Protocol == ProtocolHttpProxy {
+			return fmt.Errorf("port (at pos %d) validate failed :protocol %s is for client, use %s at server", i, v.Protocol, ProtocolDynamic)
+		}
 	}
 	return nil
 }
 
-func (c *ServerConfig) GetPort(portKey string) (*PortConfig, bool) {
+// GetPort finds the port by the id of its port key, which is what master knows
+func (c *ServerConfig) GetPort(portKeyId string, salt string) (*PortConfig, bool) {
 	// todo optimize
 	for i, v := range c.Ports {
-		if v.PortKey == portKey {
+		if v.PortKeyId(salt) == portKeyId {
 			return c.Ports[i], true
 		}
 	}
 	return nil, false
 }
 
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+	// client only, a socks5 proxy whose targets are dialed by the server
+	ProtocolSocks5 = "socks5"
+	// client only, an http proxy whose targets are dialed by the server
+	ProtocolHttpProxy = "http-proxy"
+	// server only, dials the targets asked by socks5 and http-proxy ports of clients
+	ProtocolDynamic = "dynamic"
+)
+
 type PortConfig struct {
 	Mark           string `json:"mark"`
+	Protocol       string `json:"protocol"`
 	LocalAddress   string `json:"local_address"`
 	PortKey        string `json:"port_key"`
 	EncryptMethod  string `json:"encrypt_method"`
 	CompressMethod string `json:"compress_method"`
+	// seconds, client only
+	UdpTimeout int `json:"udp_timeout"`
+	// server only, a pool of backends used instead of local_address, dead ones are skipped
+	LocalAddresses []string `json:"local_addresses"`
+	// one of the load balance strategies, round robin by default
+	Balance string `json:"balance"`
+	// seconds between health checks of local_addresses
+	HealthCheckInterval int `json:"health_check_interval"`
+	// dynamic ports only, the targets that may be dialed, except those matching deny
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	allowRules []*DialRule
+	denyRules  []*DialRule
+}
+
+// Backends is the local addresses that server connects to
+func (c *PortConfig) Backends() []string {
+	if len(c.LocalAddresses) != 0 {
+		return c.LocalAddresses
+	}
+	return []string{c.LocalAddress}
+}
+
+// AllowDial tells whether a dynamic port may dial the target, deny rules go first
+func (c *PortConfig) AllowDial(ip net.IP, port int) bool {
+	for _, v := range c.denyRules {
+		if v.Match(ip, port) {
+			return false
+		}
+	}
+	for _, v := range c.allowRules {
+		if v.Match(ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// PortKeyId is sent to master instead of the port key, salt is the one of master.
+// masters of older versions have no salt and know the port key only
+func (c *PortConfig) PortKeyId(salt string) string {
+	if salt == "" {
+		return c.PortKey
+	}
+	return crypto.PortKeyId(c.PortKey, salt)
 }
 
 func (c *PortConfig) Validate() error {
-	if c.LocalAddress == "" {
+	c.Protocol = strings.ToLower(c.Protocol)
+	if c.Protocol == "" {
+		c.Protocol = ProtocolTCP
+	}
+	switch c.Protocol {
+	case ProtocolTCP, ProtocolUDP, ProtocolSocks5, ProtocolHttpProxy, ProtocolDynamic:
+	default:
+		return fmt.Errorf("unsupported protocol %s", c.Protocol)
+	}
+	if c.UdpTimeout < 0 {
+		return fmt.Errorf("udp timeout (udp_timeout) negative")
+	}
+	if c.UdpTimeout == 0 {
+		c.UdpTimeout = 60
+	}
+	if c.Protocol == ProtocolDynamic {
+		if len(c.Allow) == 0 {
+			return fmt.Errorf("allow rules (allow) empty")
+		}
+	} else if c.LocalAddress == "" && len(c.LocalAddresses) == 0 {
 		return fmt.Errorf("local address (local_address) empty")
 	}
+	c.allowRules = nil
+	for i, v := range c.Allow {
+		rule, err := ParseDialRule(v)
+		if err != nil {
+			return fmt.Errorf("allow rule (allow at pos %d) %s", i, err)
+		}
+		c.allowRules = append(c.allowRules, rule)
+	}
+	c.denyRules = nil
+	for i, v := range c.Deny {
+		rule, err := ParseDialRule(v)
+		if err != nil {
+			return fmt.Errorf("deny rule (deny at pos %d) %s", i, err)
+		}
+		c.denyRules = append(c.denyRules, rule)
+	}
+	for i, v := range c.LocalAddresses {
+		if v == "" {
+			return fmt.Errorf("local address (local_addresses at pos %d) empty", i)
+		}
+	}
+	switch c.Balance {
+	case "", LoadBalanceRoundRobin, LoadBalanceLeastConnections, LoadBalanceRandom:
+	default:
+		return fmt.Errorf("unsupported load balance strategy (balance) %s", c.Balance)
+	}
+	if c.HealthCheckInterval < 0 {
+		return fmt.Errorf("health check interval (health_check_interval) negative")
+	}
+	if c.HealthCheckInterval == 0 {
+		c.HealthCheckInterval = 10
+	}
 	if c.PortKey == "" {
 		return fmt.Errorf("port key (port_key) empty")
 	}
@@ -93,7 +477,7 @@ func (c *PortConfig) Validate() error {
 	if c.CompressMethod == "" {
 		return fmt.Errorf("compress method (compress_method) empty")
 	}
-	if _, _, err := crypto.GetCrypto(c.EncryptMethod); err != nil {
+	if _, err := crypto.GetCryptoPair(c.EncryptMethod); err != nil {
 		return err
 	}
 	if _, _, err := compress.GetCompress(c.CompressMethod); err != nil {
@@ -103,14 +487,29 @@ func (c *PortConfig) Validate() error {
 }
 
 type ClientConfig struct {
-	Master string        `json:"master"`
-	Ports  []*PortConfig `json:"ports"`
+	Master      string        `json:"master"`
+	MuxSessions int           `json:"mux_sessions"`
+	TLS         *TLSConfig    `json:"tls"`
+	Ports       []*PortConfig `json:"ports"`
+	// talk to a master of an older version, which takes the port keys in plain text
+	AllowLegacyMaster bool `json:"allow_legacy_master"`
 }
 
 func (c *ClientConfig) Validate() error {
 	if c.Master == "" {
 		return fmt.Errorf("master address (master) empty")
 	}
+	if c.MuxSessions < 0 {
+		return fmt.Errorf("mux sessions (mux_sessions) negative")
+	}
+	if c.MuxSessions == 0 {
+		c.MuxSessions = 1
+	}
+	if c.TLS != nil {
+		if err := c.TLS.validate(false); err != nil {
+			return err
+		}
+	}
 	if len(c.Ports) == 0 {
 		return fmt.Errorf("ports empty")
 	}
@@ -120,6 +519,12 @@ func (c *ClientConfig) Validate() error {
 		if pe != nil {
 			return fmt.Errorf("port (at pos %d) validate failed :%s", i, pe.Error())
 		}
+		if v.LocalAddress == "" {
+			return fmt.Errorf("port (at pos %d) validate failed :local address (local_address) empty", i)
+		}
+		if v.Protocol == ProtocolDynamic {
+			return fmt.Errorf("port (at pos %d) validate failed :protocol %s is for server", i, v.Protocol)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DialRule matches the targets a dynamic port may dial, written as an ip or cidr,
+// optionally followed by a port or a port range, e.g. 192.168.1.0/24, 10.0.0.5:22,
+// 192.168.1.0/24:8000-8080 or [fd00::/64]:443
+type DialRule struct {
+	Net       *net.IPNet
+	StartPort int
+	EndPort   int
+}
+
+func ParseDialRule(s string) (*DialRule, error) {
+	host, ports := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid rule %s, missing ]", s)
+		}
+		host = s[1:end]
+		if rest := s[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return nil, fmt.Errorf("invalid rule %s", s)
+			}
+			ports = rest[1:]
+		}
+	} else if strings.Count(s, ":") == 1 {
+		// more colons are an ipv6 address without port
+		i := strings.Index(s, ":")
+		host, ports = s[:i], s[i+1:]
+	}
+
+	r := &DialRule{
+		StartPort: 1,
+		EndPort:   65535,
+	}
+
+	if strings.Contains(host, "/") {
+		_, ipNet, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %s: %s", s, err)
+		}
+		r.Net = ipNet
+	} else {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid rule %s, %s is neither an ip nor a cidr", s, host)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		r.Net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+
+	if ports != "" && ports != "*" {
+		start, end := ports, ports
+		if i := strings.Index(ports, "-"); i >= 0 {
+			start, end = ports[:i], ports[i+1:]
+		}
+		var err error
+		r.StartPort, err = parseRulePort(start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %s: %s", s, err)
+		}
+		r.EndPort, err = parseRulePort(end)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %s: %s", s, err)
+		}
+		if r.StartPort > r.EndPort {
+			return nil, fmt.Errorf("invalid rule %s, port range reversed", s)
+		}
+	}
+	return r, nil
+}
+
+func parseRulePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %s", s)
+	}
+	return port, nil
+}
+
+func (r *DialRule) Match(ip net.IP, port int) bool {
+	return r.Net.Contains(ip) && port >= r.StartPort && port <= r.EndPort
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseDialRule(t *testing.T) {
+	tests := []struct {
+		rule      string
+		net       string
+		startPort int
+		endPort   int
+		fail      bool
+	}{
+		{"10.0.0.5", "10.0.0.5/32", 1, 65535, false},
+		{"10.0.0.5:22", "10.0.0.5/32", 22, 22, false},
+		{"192.168.1.0/24", "192.168.1.0/24", 1, 65535, false},
+		{"192.168.1.0/24:8000-8080", "192.168.1.0/24", 8000, 8080, false},
+		{"192.168.1.0/24:*", "192.168.1.0/24", 1, 65535, false},
+		{"::1", "::1/128", 1, 65535, false},
+		{"fd00::/64", "fd00::/64", 1, 65535, false},
+		{"[fd00::/64]:443", "fd00::/64", 443, 443, false},
+		{"[::1]", "::1/128", 1, 65535, false},
+		{"[::ffff:10.0.0.1]:80", "10.0.0.1/32", 80, 80, false},
+		{"", "", 0, 0, true},
+		{"example.com:80", "", 0, 0, true},
+		{"10.0.0.5:0", "", 0, 0, true},
+		{"10.0.0.5:65536", "", 0, 0, true},
+		{"10.0.0.5:80-22", "", 0, 0, true},
+		{"10.0.0.5:a", "", 0, 0, true},
+		{"10.0.0.0/33", "", 0, 0, true},
+		{"[::1", "", 0, 0, true},
+		{"[::1]80", "", 0, 0, true},
+	}
+	for _, tt := range tests {
+		r, err := ParseDialRule(tt.rule)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%q parsed as %s:%d-%d", tt.rule, r.Net, r.StartPort, r.EndPort)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tt.rule, err)
+			continue
+		}
+		if r.Net.String() != tt.net || r.StartPort != tt.startPort || r.EndPort != tt.endPort {
+			t.Errorf("%q parsed as %s:%d-%d", tt.rule, r.Net, r.StartPort, r.EndPort)
+		}
+	}
+}
+
+func TestAllowDial(t *testing.T) {
+	c := &PortConfig{
+		Mark:           "dynamic",
+		PortKey:        "dynamic",
+		Protocol:       ProtocolDynamic,
+		EncryptMethod:  "plain",
+		CompressMethod: "null",
+		Allow:          []string{"10.0.0.0/8", "[fd00::/64]:443", "192.168.1.1:8000-8080"},
+		Deny:           []string{"10.0.0.1", "10.1.0.0/16:22"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		allow  bool
+	}{
+		{"10.2.3.4:80", true},
+		{"10.0.0.1:80", false},
+		{"10.1.2.3:22", false},
+		{"10.1.2.3:23", true},
+		{"11.0.0.1:80", false},
+		{"[fd00::1]:443", true},
+		{"[fd00::1]:80", false},
+		{"[fd01::1]:443", false},
+		{"192.168.1.1:8000", true},
+		{"192.168.1.1:8080", true},
+		{"192.168.1.1:8081", false},
+		{"192.168.1.2:8000", false},
+		{"[::ffff:10.2.3.4]:80", true},
+	}
+	for _, tt := range tests {
+		addr, err := net.ResolveTCPAddr("tcp", tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allow := c.AllowDial(addr.IP, addr.Port); allow != tt.allow {
+			t.Errorf("AllowDial(%s) = %v", tt.target, allow)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig wraps the connections between master and server/client in tls,
+// the same fields are used by both ends
+type TLSConfig struct {
+	// certificate of master, or the client certificate of server/client
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// master uses it to verify certificates of servers and clients,
+	// server/client use it to verify master instead of the system roots
+	CA string `json:"ca"`
+
+	// server/client only
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+
+	// master only
+	RequireServerCert bool `json:"require_server_cert"`
+	RequireClientCert bool `json:"require_client_cert"`
+}
+
+func (c *TLSConfig) validate(master bool) error {
+	if (c.Cert == "") != (c.Key == "") {
+		return fmt.Errorf("tls cert (tls.cert) and key (tls.key) must be set together")
+	}
+	if master {
+		if c.Cert == "" {
+			return fmt.Errorf("tls cert (tls.cert) empty")
+		}
+		if (c.RequireServerCert || c.RequireClientCert) && c.CA == "" {
+			return fmt.Errorf("tls ca (tls.ca) is required to verify peer certificates")
+		}
+	}
+	return nil
+}
+
+func (c *TLSConfig) loadCA() (*x509.CertPool, error) {
+	if c.CA == "" {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadFile(c.CA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificate found in %s", c.CA)
+	}
+	return pool, nil
+}
+
+// MasterTLSConfig is used by the listener of master
+func (c *TLSConfig) MasterTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := c.loadCA()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch {
+	case c.RequireClientCert:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case pool != nil:
+		// servers are checked after handshake if require_server_cert is set
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// DialTLSConfig is used by server and client to dial master
+func (c *TLSConfig) DialTLSConfig() (*tls.Config, error) {
+	pool, err := c.loadCA()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		RootCAs:            pool,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
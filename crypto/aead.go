@@ -0,0 +1,199 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// every record is [sealed 2 bytes payload length][sealed payload],
+// the nonce is a counter incremented after each seal so that a replayed,
+// dropped or reordered record fails to open. a record without payload ends the stream,
+// so a stream cut by an attacker is not taken as finished
+const AeadMaxPayloadSize = 0x3FFF
+
+type aeadWriter struct {
+	aead  cipher.AEAD
+	nonce []byte
+	w     io.Writer
+}
+
+func (w *aeadWriter) Write(buf []byte) (int, error) {
+	n := 0
+	for len(buf) > 0 {
+		chunk := buf
+		if len(chunk) > AeadMaxPayloadSize {
+			chunk = chunk[:AeadMaxPayloadSize]
+		}
+
+		_, err := w.w.Write(w.seal(chunk))
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		buf = buf[len(chunk):]
+	}
+	return n, nil
+}
+
+func (w *aeadWriter) seal(chunk []byte) []byte {
+	record := make([]byte, 2, 2+len(chunk)+w.aead.Overhead()*2)
+	binary.BigEndian.PutUint16(record, uint16(len(chunk)))
+	record = w.aead.Seal(record[:0], w.nonce, record, nil)
+	increaseNonce(w.nonce)
+	record = w.aead.Seal(record, w.nonce, chunk, nil)
+	increaseNonce(w.nonce)
+	return record
+}
+
+func (w *aeadWriter) writeEnd() error {
+	_, err := w.w.Write(w.seal(nil))
+	return err
+}
+
+type aeadReader struct {
+	aead  cipher.AEAD
+	nonce []byte
+	r     io.Reader
+
+	// opened but not read yet
+	left []byte
+	// the end record was read
+	end bool
+}
+
+func (r *aeadReader) Read(buf []byte) (int, error) {
+	if len(r.left) == 0 {
+		if r.end {
+			return 0, io.EOF
+		}
+		err := r.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		if r.end {
+			return 0, io.EOF
+		}
+	}
+	n := copy(buf, r.left)
+	r.left = r.left[n:]
+	return n, nil
+}
+
+func (r *aeadReader) readRecord() error {
+	lenBuf := make([]byte, 2+r.aead.Overhead())
+	_, err := io.ReadFull(r.r, lenBuf)
+	if err != nil {
+		if err == io.EOF {
+			// the peer did not end the stream
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	lenBuf, err = r.aead.Open(lenBuf[:0], r.nonce, lenBuf, nil)
+	if err != nil {
+		return fmt.Errorf("open record length failed: %s", err)
+	}
+	increaseNonce(r.nonce)
+
+	length := binary.BigEndian.Uint16(lenBuf)
+	if length > AeadMaxPayloadSize {
+		return fmt.Errorf("record too long: %d", length)
+	}
+
+	payload := make([]byte, int(length)+r.aead.Overhead())
+	_, err = io.ReadFull(r.r, payload)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	payload, err = r.aead.Open(payload[:0], r.nonce, payload, nil)
+	if err != nil {
+		return fmt.Errorf("open record failed: %s", err)
+	}
+	increaseNonce(r.nonce)
+
+	r.left = payload
+	r.end = length == 0
+	return nil
+}
+
+// little endian counter
+func increaseNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// AeadCrypto is one direction of an aead method,
+// the cipher is set up lazily because setting it up may need to read from the peer
+type AeadCrypto struct {
+	r io.Reader
+	w io.Writer
+	c io.Closer
+
+	setup    func() (cipher.AEAD, error)
+	once     sync.Once
+	setupErr error
+	reader   *aeadReader
+	writer   *aeadWriter
+}
+
+func (c *AeadCrypto) init() {
+	aead, err := c.setup()
+	if err != nil {
+		c.setupErr = err
+		return
+	}
+	if c.r != nil {
+		c.reader = &aeadReader{
+			aead:  aead,
+			nonce: make([]byte, aead.NonceSize()),
+			r:     c.r,
+		}
+	}
+	if c.w != nil {
+		c.writer = &aeadWriter{
+			aead:  aead,
+			nonce: make([]byte, aead.NonceSize()),
+			w:     c.w,
+		}
+	}
+}
+
+func (c *AeadCrypto) Read(buf []byte) (int, error) {
+	c.once.Do(c.init)
+	if c.setupErr != nil {
+		return 0, c.setupErr
+	}
+	return c.reader.Read(buf)
+}
+
+func (c *AeadCrypto) Write(buf []byte) (int, error) {
+	c.once.Do(c.init)
+	if c.setupErr != nil {
+		return 0, c.setupErr
+	}
+	return c.writer.Write(buf)
+}
+
+// Close of the writer sends the end record before closing
+func (c *AeadCrypto) Close() error {
+	if c.w != nil {
+		c.once.Do(c.init)
+		if c.setupErr == nil {
+			c.writer.writeEnd()
+		}
+	}
+	if c.c != nil {
+		c.c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+var testAeadMethods = []string{"aes-256-gcm", "chacha20-poly1305"}
+
+// seal writes data with the method and ends the stream
+func seal(t *testing.T, method string, key string, data []byte) []byte {
+	_, wf, err := GetCrypto(method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bufferCloser
+	w, err := wf(key, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return out.Bytes()
+}
+
+func open(t *testing.T, method string, key string, sealed []byte) ([]byte, error) {
+	rf, _, err := GetCrypto(method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := rf(key, &bufferCloser{Buffer: *bytes.NewBuffer(sealed)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestAeadRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, AeadMaxPayloadSize, AeadMaxPayloadSize + 1, 3*AeadMaxPayloadSize + 7}
+	for _, method := range testAeadMethods {
+		for _, size := range sizes {
+			data := bytes.Repeat([]byte{'c'}, size)
+			got, err := open(t, method, "key", seal(t, method, "key", data))
+			if err != nil {
+				t.Fatalf("%s of %d bytes: %s", method, size, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%s of %d bytes opened as %d bytes", method, size, len(got))
+			}
+		}
+	}
+}
+
+func TestAeadTampered(t *testing.T) {
+	// both methods have tags of 16 bytes, the records of one byte written below take 35 bytes
+	const record = 2 + 16 + 1 + 16
+	tests := []struct {
+		name   string
+		key    string
+		tamper func(sealed []byte) []byte
+		err    error
+	}{
+		{"wrong key", "other key", func(b []byte) []byte { return b }, nil},
+		{"end record cut", "key", func(b []byte) []byte { return b[:pskSaltSize+2*record] }, io.ErrUnexpectedEOF},
+		{"record cut", "key", func(b []byte) []byte { return b[:pskSaltSize+record+10] }, io.ErrUnexpectedEOF},
+		{"length flipped", "key", func(b []byte) []byte {
+			b[pskSaltSize] ^= 1
+			return b
+		}, nil},
+		{"payload flipped", "key", func(b []byte) []byte {
+			b[pskSaltSize+2+16] ^= 1
+			return b
+		}, nil},
+		{"records reordered", "key", func(b []byte) []byte {
+			reordered := append([]byte{}, b[:pskSaltSize]...)
+			reordered = append(reordered, b[pskSaltSize+record:pskSaltSize+2*record]...)
+			reordered = append(reordered, b[pskSaltSize:pskSaltSize+record]...)
+			return append(reordered, b[pskSaltSize+2*record:]...)
+		}, nil},
+		{"record replayed", "key", func(b []byte) []byte {
+			replayed := append([]byte{}, b[:pskSaltSize+record]...)
+			return append(replayed, b[pskSaltSize:]...)
+		}, nil},
+	}
+	for _, method := range testAeadMethods {
+		for _, tt := range tests {
+			_, wf, _ := GetCrypto(method)
+			var out bufferCloser
+			w, err := wf("key", &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte{'a'})
+			w.Write([]byte{'b'})
+			w.Close()
+
+			got, err := open(t, method, tt.key, tt.tamper(out.Bytes()))
+			if err == nil {
+				t.Errorf("%s %s: opened %q", method, tt.name, got)
+				continue
+			}
+			if tt.err != nil && err != tt.err {
+				t.Errorf("%s %s: %s instead of %s", method, tt.name, err, tt.err)
+			}
+		}
+	}
+}
+
+func TestAeadReplayed(t *testing.T) {
+	for _, method := range testAeadMethods {
+		sealed := seal(t, method, "key", []byte("hello crab"))
+		if _, err := open(t, method, "key", sealed); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := open(t, method, "key", sealed); err == nil {
+			t.Errorf("%s: replayed stream opened as %q", method, got)
+		}
+	}
+}
+
+func TestSaltFilter(t *testing.T) {
+	f := &saltFilter{}
+	a, b := []byte("salt a"), []byte("salt b")
+
+	steps := []struct {
+		name   string
+		rotate bool
+		salt   []byte
+		added  bool
+	}{
+		{"new", false, a, true},
+		{"seen", false, a, false},
+		{"another new", false, b, true},
+		{"seen in the previous window", true, a, false},
+		{"forgotten after two windows", true, b, true},
+		{"seen again", false, b, false},
+	}
+	for _, v := range steps {
+		if v.rotate {
+			f.rotateAt = time.Now().Add(-time.Second)
+		}
+		if added := f.add(v.salt); added != v.added {
+			t.Fatalf("%s: added %v", v.name, added)
+		}
+	}
+}
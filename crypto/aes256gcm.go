@@ -0,0 +1,27 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+)
+
+func newAes256Gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func NewAes256GcmCryptoReader(key string, r io.ReadCloser) (Crypto, error) {
+	return newSaltedAeadReader("aes-256-gcm", 32, newAes256Gcm, key, r)
+}
+
+func NewAes256GcmCryptoWriter(key string, w io.WriteCloser) (Crypto, error) {
+	return newSaltedAeadWriter("aes-256-gcm", 32, newAes256Gcm, key, w)
+}
+
+func init() {
+	registerCrypto("aes-256-gcm", NewAes256GcmCryptoReader, NewAes256GcmCryptoWriter)
+}
@@ -0,0 +1,18 @@
+package crypto
+
+import (
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+)
+
+func NewChacha20Poly1305CryptoReader(key string, r io.ReadCloser) (Crypto, error) {
+	return newSaltedAeadReader("chacha20-poly1305", chacha20poly1305.KeySize, chacha20poly1305.New, key, r)
+}
+
+func NewChacha20Poly1305CryptoWriter(key string, w io.WriteCloser) (Crypto, error) {
+	return newSaltedAeadWriter("chacha20-poly1305", chacha20poly1305.KeySize, chacha20poly1305.New, key, w)
+}
+
+func init() {
+	registerCrypto("chacha20-poly1305", NewChacha20Poly1305CryptoReader, NewChacha20Poly1305CryptoWriter)
+}
@@ -1,9 +1,12 @@
 package crypto
 
 import (
+	"encoding/hex"
 	"fmt"
+	"golang.org/x/crypto/argon2"
 	"io"
 	"strings"
+	"sync"
 )
 
 type Crypto interface {
@@ -15,8 +18,13 @@ type Crypto interface {
 type NewCryptoReaderFunc func(key string, r io.ReadCloser) (Crypto, error)
 type NewCryptoWriterFunc func(key string, w io.WriteCloser) (Crypto, error)
 
+// NewCryptoPairFunc creates the reader and writer of a connection together,
+// for methods whose two directions share state such as a key exchange
+type NewCryptoPairFunc func(key string, rw io.ReadWriteCloser) (r Crypto, w Crypto, err error)
+
 var cryptoReaderFuncMap map[string]NewCryptoReaderFunc
 var cryptoWriterFuncMap map[string]NewCryptoWriterFunc
+var cryptoPairFuncMap map[string]NewCryptoPairFunc
 
 func registerCrypto(name string, rf NewCryptoReaderFunc, wf NewCryptoWriterFunc) {
 	name = strings.ToLower(name)
@@ -39,3 +47,62 @@ func GetCrypto(name string) (NewCryptoReaderFunc, NewCryptoWriterFunc, error) {
 	}
 	return rf, wf, nil
 }
+
+func registerCryptoPair(name string, f NewCryptoPairFunc) {
+	name = strings.ToLower(name)
+	if cryptoPairFuncMap == nil {
+		cryptoPairFuncMap = make(map[string]NewCryptoPairFunc)
+	}
+	cryptoPairFuncMap[name] = f
+}
+
+// GetCryptoPair works for every method, methods registered by direction are combined,
+// the writer is always created first
+func GetCryptoPair(name string) (NewCryptoPairFunc, error) {
+	name = strings.ToLower(name)
+	if f, ok := cryptoPairFuncMap[name]; ok {
+		return f, nil
+	}
+
+	rf, wf, err := GetCrypto(name)
+	if err != nil {
+		return nil, err
+	}
+	return func(key string, rw io.ReadWriteCloser) (Crypto, Crypto, error) {
+		w, err := wf(key, rw)
+		if err != nil {
+			return nil, nil, err
+		}
+		r, err := rf(key, rw)
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, w, nil
+	}, nil
+}
+
+// ids are slow to derive on purpose, the cache is dropped when full because
+// sides of older versions may send any port key
+const portKeyIdCacheSize = 4096
+
+var portKeyIdCache = make(map[string]string)
+var portKeyIdCacheLock sync.Mutex
+
+// PortKeyId identifies a port key at master without revealing it, the port key itself is only used
+// to encrypt traffic. it is stretched with the salt of master, so that a dictionary of ids made for
+// one master is useless for others and every guess is as slow as an encryption key
+func PortKeyId(key string, salt string) string {
+	portKeyIdCacheLock.Lock()
+	defer portKeyIdCacheLock.Unlock()
+
+	cacheKey := salt + "\x00" + key
+	id, ok := portKeyIdCache[cacheKey]
+	if !ok {
+		if len(portKeyIdCache) >= portKeyIdCacheSize {
+			portKeyIdCache = make(map[string]string)
+		}
+		id = hex.EncodeToString(argon2.IDKey([]byte(key), []byte("crab port key id "+salt), 1, 64*1024, 4, 32))
+		portKeyIdCache[cacheKey] = id
+	}
+	return id
+}
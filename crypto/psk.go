@@ -0,0 +1,125 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+	"time"
+)
+
+const pskSaltSize = 32
+
+// stretching the port key is slow on purpose, so it is done once per key and method
+var pskCache = make(map[string][]byte)
+var pskCacheLock sync.Mutex
+
+func getPsk(method string, key string) []byte {
+	pskCacheLock.Lock()
+	defer pskCacheLock.Unlock()
+
+	cacheKey := method + "\x00" + key
+	psk, ok := pskCache[cacheKey]
+	if !ok {
+		psk = argon2.IDKey([]byte(key), []byte("crab "+method), 1, 64*1024, 4, 32)
+		pskCache[cacheKey] = psk
+	}
+	return psk
+}
+
+// every direction starts with a random salt, the traffic key of this direction is
+// derived from the stretched port key and the salt, so keys never repeat across connections
+func deriveSaltedKey(method string, key string, salt []byte, size int) ([]byte, error) {
+	subKey := make([]byte, size)
+	_, err := io.ReadFull(hkdf.New(sha256.New, getPsk(method, key), salt, []byte("crab "+method)), subKey)
+	if err != nil {
+		return nil, err
+	}
+	return subKey, nil
+}
+
+// salts are remembered for one to two windows, so a recorded stream replayed into a new connection
+// within that time is rejected. the memory is bounded by the connections made in two windows
+const PskSaltReplayWindow = time.Minute * 10
+
+type saltFilter struct {
+	lock     sync.Mutex
+	current  map[string]bool
+	previous map[string]bool
+	rotateAt time.Time
+}
+
+var pskSaltFilter = &saltFilter{}
+
+// add returns false if the salt was seen
+func (f *saltFilter) add(salt []byte) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := time.Now()
+	if now.After(f.rotateAt) {
+		f.previous = f.current
+		f.current = make(map[string]bool)
+		f.rotateAt = now.Add(PskSaltReplayWindow)
+	}
+
+	k := string(salt)
+	if f.current[k] || f.previous[k] {
+		return false
+	}
+	f.current[k] = true
+	return true
+}
+
+func newSaltedAeadReader(method string, keySize int, newAead func(key []byte) (cipher.AEAD, error), key string, r io.ReadCloser) (Crypto, error) {
+	return &AeadCrypto{
+		r: r,
+		c: r,
+		setup: func() (cipher.AEAD, error) {
+			salt := make([]byte, pskSaltSize)
+			_, err := io.ReadFull(r, salt)
+			if err != nil {
+				return nil, err
+			}
+			if !pskSaltFilter.add(salt) {
+				return nil, fmt.Errorf("salt replayed")
+			}
+			subKey, err := deriveSaltedKey(method, key, salt, keySize)
+			if err != nil {
+				return nil, err
+			}
+			return newAead(subKey)
+		},
+	}, nil
+}
+
+func newSaltedAeadWriter(method string, keySize int, newAead func(key []byte) (cipher.AEAD, error), key string, w io.WriteCloser) (Crypto, error) {
+	salt, err := getRandomBytes(pskSaltSize)
+	if err != nil {
+		return nil, err
+	}
+	subKey, err := deriveSaltedKey(method, key, salt, keySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAead(subKey)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AeadCrypto{
+		w: w,
+		c: w,
+		setup: func() (cipher.AEAD, error) {
+			return aead, nil
+		},
+	}, nil
+}
@@ -10,6 +10,18 @@ const (
 	ResponseCodeNewClientComing       = 6
 	ResponseCodeServerRejectClient    = 7
 	ResponseCodeServerAcceptClient    = 8
+	ResponseCodeServerCertRequired    = 9
+	ResponseCodeAuthChallenge         = 10
+	ResponseCodePortKeyRegDenied      = 11
+	ResponseCodePortKeyConnectDenied  = 12
+	ResponseCodeQuotaExceeded         = 13
+	ResponseCodePortKeyUnregSuccess   = 14
+	ResponseCodePortKeyNotOwned       = 15
+	ResponseCodePong                  = 16
+	ResponseCodeHello                 = 17
+	ResponseCodeAuthProof             = 18
+	ResponseCodePortKeyClaimGranted   = 19
+	ResponseCodePortKeyClaimDenied    = 20
 )
 
 const (
@@ -23,4 +35,14 @@ const (
 	CommandServerRegisterPortKey     = 0x3
 	CommandServerRejectClientRequest = 0x4
 	CommandServerAcceptClientRequest = 0x5
+	CommandClientMuxHandshake        = 0x7
+	CommandServerAuthHandshake       = 0x8
+	CommandServerAuthResponse        = 0x9
+	CommandServerUnregisterPortKey   = 0xA
+	CommandServerPing                = 0xB
+	CommandPeerHandshake             = 0xC
+	CommandPeerPortKeyAdd            = 0xD
+	CommandPeerPortKeyRemove         = 0xE
+	CommandHello                     = 0xF
+	CommandPeerPortKeyClaim          = 0x10
 )
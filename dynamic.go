@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/crabkun/crab/config"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// a tunnel of a dynamic port starts with a request from the client, [network][target address],
+// and the reply of the server, [status][error message], both framed like datagrams.
+// then a tcp tunnel carries the stream to the target, while every datagram of an udp tunnel
+// is prefixed with [address length][address] telling where it goes to or comes from
+
+const (
+	DynamicNetworkTCP = 1
+	DynamicNetworkUDP = 2
+)
+
+const (
+	DynamicDialSuccess = 0
+	DynamicDialDenied  = 1
+	DynamicDialFailed  = 2
+)
+
+const DynamicMaxAddressSize = 0xFF
+
+// the server dials the target within DynamicDialTimeout,
+// the client waits for the reply a little longer
+const DynamicDialTimeout = time.Second * 8
+const DynamicReplyTimeout = DynamicDialTimeout + time.Second*4
+
+var errDialDenied = errors.New("target not allowed")
+
+func packDynamicDatagram(addr string, data []byte) ([]byte, error) {
+	if len(addr) > DynamicMaxAddressSize {
+		return nil, fmt.Errorf("address too long")
+	}
+	buf := make([]byte, 0, 1+len(addr)+len(data))
+	buf = append(buf, byte(len(addr)))
+	buf = append(buf, addr...)
+	return append(buf, data...), nil
+}
+
+func unpackDynamicDatagram(buf []byte) (string, []byte, error) {
+	if len(buf) == 0 || int(buf[0]) >= len(buf) {
+		return "", nil, fmt.Errorf("invalid dynamic datagram")
+	}
+	return string(buf[1 : 1+buf[0]]), buf[1+buf[0]:], nil
+}
+
+// clientDialDynamic asks the server of the port to dial the target,
+// the tunnel is returned along with the status replied by the server
+func clientDialDynamic(cfg *config.PortConfig, network uint8, addr string, l *log.Entry) (io.ReadCloser, io.WriteCloser, uint8) {
+	master, ok := clientMatchServer(cfg, l)
+	if !ok {
+		return nil, nil, DynamicDialFailed
+	}
+
+	masterToRemote, remoteToMaster, err := wrapTunnel(cfg, master)
+	if err != nil {
+		l.WithError(err).Errorln("init tunnel failed")
+		master.Close()
+		return nil, nil, DynamicDialFailed
+	}
+
+	// cut if the server never replies
+	master.SetDeadline(time.Now().Add(DynamicReplyTimeout))
+
+	err = writeDatagram(remoteToMaster, append([]byte{network}, addr...))
+	if err != nil {
+		l.WithError(err).Errorln("send dial request failed")
+		remoteToMaster.Close()
+		return nil, nil, DynamicDialFailed
+	}
+	reply, err := readDatagram(masterToRemote)
+	if err != nil || len(reply) == 0 {
+		l.WithError(err).Errorln("read dial reply failed")
+		remoteToMaster.Close()
+		return nil, nil, DynamicDialFailed
+	}
+
+	status := reply[0]
+	switch status {
+	case DynamicDialSuccess:
+		master.SetDeadline(time.Time{})
+		return masterToRemote, remoteToMaster, status
+	case DynamicDialDenied:
+		l.Warnln("server reported that the target is not allowed")
+	default:
+		l.WithField("error", string(reply[1:])).Errorln("server reported that connect to target failed")
+	}
+	remoteToMaster.Close()
+	return nil, nil, status
+}
+
+// serverHandleDynamicClient dials the target asked by the client of a dynamic port,
+// only the ips and ports allowed by the port are dialed
+func serverHandleDynamicClient(req *clientRequest, portCfg *config.PortConfig) bool {
+	l := log.WithFields(log.Fields{
+		"master":      req.RemoteAddr(),
+		"client_guid": req.Guid,
+		"port_mark":   portCfg.Mark,
+	})
+
+	stream, err := req.Accept()
+	if err != nil {
+		l.WithError(err).Errorln("accept client failed")
+		return false
+	}
+
+	masterToRemote, remoteToMaster, err := wrapTunnel(portCfg, stream)
+	if err != nil {
+		l.WithError(err).Errorln("init tunnel failed")
+		stream.Close()
+		return false
+	}
+
+	// the tunnel owns the stream from now on
+	go serverServeDynamic(stream, masterToRemote, remoteToMaster, portCfg, l)
+	return true
+}
+
+func serverServeDynamic(stream net.Conn, masterToRemote io.ReadCloser, remoteToMaster io.WriteCloser,
+	portCfg *config.PortConfig, l *log.Entry) {
+	// disconnect if no request in 10s
+	stream.SetDeadline(time.Now().Add(time.Second * 10))
+
+	request, err := readDatagram(masterToRemote)
+	if err != nil || len(request) == 0 {
+		l.WithError(err).Debugln("read dial request failed")
+		remoteToMaster.Close()
+		return
+	}
+	network := request[0]
+	target := string(request[1:])
+	l = l.WithFields(log.Fields{
+		"target": target,
+	})
+
+	var conn net.Conn
+	switch network {
+	case DynamicNetworkTCP:
+		conn, err = dynamicDial(portCfg, target)
+	case DynamicNetworkUDP:
+		conn, err = net.ListenUDP("udp", nil)
+	default:
+		err = fmt.Errorf("unsupported network %d", network)
+	}
+	if err != nil {
+		status := uint8(DynamicDialFailed)
+		if errors.Is(err, errDialDenied) {
+			status = DynamicDialDenied
+			l.Warnln("target not allowed")
+		} else {
+			l.WithError(err).Errorln("connect to target failed")
+			serverLocalDialFailures.WithLabelValues(portCfg.Mark).Inc()
+		}
+		writeDatagram(remoteToMaster, append([]byte{status}, err.Error()...))
+		remoteToMaster.Close()
+		return
+	}
+
+	err = writeDatagram(remoteToMaster, []byte{DynamicDialSuccess})
+	if err != nil {
+		l.WithError(err).Debugln("send dial reply failed")
+		conn.Close()
+		remoteToMaster.Close()
+		return
+	}
+	stream.SetDeadline(time.Time{})
+
+	serverActiveBridges.Inc()
+
+	if network == DynamicNetworkUDP {
+		l.Debugln("dynamic udp session started")
+		serverDynamicUdp(conn.(*net.UDPConn), masterToRemote, remoteToMaster, portCfg, l)
+		serverActiveBridges.Dec()
+		l.Debugln("dynamic udp session closed")
+		return
+	}
+
+	l.Debugln("connected to target")
+	relayPair(conn, remoteToMaster, masterToRemote, conn, nil, nil, func(download, upload RelayResult) {
+		serverActiveBridges.Dec()
+		l.WithFields(log.Fields{
+			"upload":       upload.Bytes,
+			"download":     download.Bytes,
+			"upload_end":   upload.Cause(),
+			"download_end": download.Cause(),
+		}).Debugln("bridge closed")
+	})
+}
+
+// dynamicDial checks the resolved address right before connecting,
+// so that a host name can't be resolved to a target which is not allowed
+func dynamicDial(portCfg *config.PortConfig, target string) (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout: DynamicDialTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if !dynamicAllowed(portCfg, address) {
+				return errDialDenied
+			}
+			return nil
+		},
+	}
+	return d.Dial("tcp", target)
+}
+
+func dynamicAllowed(portCfg *config.PortConfig, address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	return ip != nil && err == nil && portCfg.AllowDial(ip, p)
+}
+
+// serverDynamicUdp relays the datagrams of the tunnel to their targets and the replies back,
+// datagrams to or from the targets not allowed are dropped. it returns after the tunnel was closed
+func serverDynamicUdp(conn *net.UDPConn, r io.ReadCloser, w io.WriteCloser, portCfg *config.PortConfig, l *log.Entry) {
+	var dropped int64
+	go func() {
+		defer func() {
+			conn.Close()
+			w.Close()
+		}()
+		buf := make([]byte, UdpMaxDatagramSize-1-DynamicMaxAddressSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !portCfg.AllowDial(addr.IP, addr.Port) {
+				atomic.AddInt64(&dropped, 1)
+				continue
+			}
+			data, err := packDynamicDatagram(addr.String(), buf[:n])
+			if err != nil {
+				continue
+			}
+			if writeDatagram(w, data) != nil {
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		r.Close()
+		conn.Close()
+		if n := atomic.LoadInt64(&dropped); n != 0 {
+			l.WithField("dropped", n).Debugln("datagrams of targets not allowed dropped")
+		}
+	}()
+
+	// host names are resolved once per session
+	resolved := make(map[string]*net.UDPAddr)
+	for {
+		buf, err := readDatagram(r)
+		if err != nil {
+			return
+		}
+		target, data, err := unpackDynamicDatagram(buf)
+		if err != nil {
+			return
+		}
+
+		addr, exist := resolved[target]
+		if !exist {
+			addr, err = net.ResolveUDPAddr("udp", target)
+			if err != nil {
+				l.WithError(err).WithField("target", target).Debugln("resolve target failed")
+				continue
+			}
+			if len(resolved) >= 1024 {
+				resolved = make(map[string]*net.UDPAddr)
+			}
+			resolved[target] = addr
+		}
+		if !portCfg.AllowDial(addr.IP, addr.Port) {
+			atomic.AddInt64(&dropped, 1)
+			continue
+		}
+		conn.WriteToUDP(data, addr)
+	}
+}
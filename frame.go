@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// a packet is written after its length in 2 bytes, packets longer than 0xFFFF are written
+// after a zero length and the real length in 4 bytes
+
+const DefaultMaxPacketSize = 16 << 20
+
+// packets of the hello and the handshakes are short, so that anyone reaching master
+// can't make it allocate max_packet_size before being authenticated
+const HandshakePacketSize = 64 << 10
+
+// maxPacketSize limits the packets read and written, set by max_packet_size
+var maxPacketSize int64 = DefaultMaxPacketSize
+
+func SetMaxPacketSize(size int) {
+	atomic.StoreInt64(&maxPacketSize, int64(size))
+}
+
+func MaxPacketSize() int {
+	return int(atomic.LoadInt64(&maxPacketSize))
+}
+
+// FrameReader reads whole packets however they are segmented. it reads no more than one packet
+// because the connection is handed over to mux session or tunnel after the handshake
+type FrameReader struct {
+	r       io.Reader
+	maxSize int
+	lenBuf  [4]byte
+}
+
+func NewFrameReader(r io.Reader, maxSize int) *FrameReader {
+	return &FrameReader{
+		r:       r,
+		maxSize: maxSize,
+	}
+}
+
+func (f *FrameReader) ReadFrame() ([]byte, error) {
+	_, err := io.ReadFull(f.r, f.lenBuf[:2])
+	if err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(f.lenBuf[:2]))
+	if length == 0 {
+		// a long packet, the real length follows
+		_, err = io.ReadFull(f.r, f.lenBuf[:4])
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		length = int(binary.BigEndian.Uint32(f.lenBuf[:4]))
+		if length <= 0xFFFF {
+			return nil, fmt.Errorf("read packet length failed, invalid long packet length %d", length)
+		}
+	}
+	if length > f.maxSize {
+		return nil, fmt.Errorf("read packet length failed, %d exceeds max packet size %d", length, f.maxSize)
+	}
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(f.r, buf)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf, nil
+}
+
+// FrameWriter writes the length and the packet in a single write,
+// so that packets written by several goroutines are not interleaved
+type FrameWriter struct {
+	w       io.Writer
+	maxSize int
+}
+
+func NewFrameWriter(w io.Writer, maxSize int) *FrameWriter {
+	return &FrameWriter{
+		w:       w,
+		maxSize: maxSize,
+	}
+}
+
+func (f *FrameWriter) WriteFrame(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("write packet failed, empty packet")
+	}
+	if len(data) > f.maxSize {
+		return fmt.Errorf("write packet failed, %d exceeds max packet size %d", len(data), f.maxSize)
+	}
+
+	var buf []byte
+	if len(data) > 0xFFFF {
+		buf = make([]byte, 6, 6+len(data))
+		binary.BigEndian.PutUint32(buf[2:], uint32(len(data)))
+	} else {
+		buf = make([]byte, 2, 2+len(data))
+		binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	}
+	buf = append(buf, data...)
+
+	_, err := f.w.Write(buf)
+	return err
+}
+
+// unexpectedEOF tells a packet cut in the middle from a connection closed between packets
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+const testMaxPacketSize = 1 << 17
+
+func longHeader(length uint32) []byte {
+	buf := make([]byte, 6)
+	binary.BigEndian.PutUint32(buf[2:], length)
+	return buf
+}
+
+func FuzzReadFrame(f *testing.F) {
+	// short packets
+	f.Add([]byte{0, 1, 'a'})
+	f.Add([]byte{0xFF, 0xFF})
+	f.Add(append([]byte{0, 3}, "abcdef"...))
+	// long packets, whole and cut
+	f.Add(append(longHeader(0x10000), make([]byte, 0x10000)...))
+	f.Add(append(longHeader(0x10001), 'a'))
+	// truncated headers
+	f.Add([]byte{})
+	f.Add([]byte{0})
+	f.Add([]byte{0, 0, 0})
+	f.Add([]byte{0, 0, 0, 1, 0})
+	// long form of a length which fits in 2 bytes
+	f.Add(longHeader(0))
+	f.Add(longHeader(1))
+	f.Add(longHeader(0xFFFF))
+	// over max packet size
+	f.Add(longHeader(testMaxPacketSize + 1))
+	f.Add(longHeader(0xFFFFFFFF))
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		r := bytes.NewReader(input)
+		buf, err := NewFrameReader(r, testMaxPacketSize).ReadFrame()
+		if err == io.EOF && len(input) != 0 {
+			t.Fatalf("io.EOF after reading %d bytes", len(input)-r.Len())
+		}
+		if err != nil {
+			return
+		}
+
+		if len(buf) == 0 || len(buf) > testMaxPacketSize {
+			t.Fatalf("read a packet of %d bytes", len(buf))
+		}
+
+		// the packet is written back in the same form as read
+		consumed := input[:len(input)-r.Len()]
+		var out bytes.Buffer
+		err = NewFrameWriter(&out, testMaxPacketSize).WriteFrame(buf)
+		if err != nil {
+			t.Fatalf("write the packet read failed: %s", err)
+		}
+		if !bytes.Equal(out.Bytes(), consumed) {
+			t.Fatalf("packet of %d bytes written in %d bytes, read from %d bytes", len(buf), out.Len(), len(consumed))
+		}
+	})
+}
+
+func FuzzWriteReadFrame(f *testing.F) {
+	f.Add([]byte("a"), uint16(0), uint32(testMaxPacketSize))
+	f.Add([]byte{}, uint16(0), uint32(testMaxPacketSize))
+	// around the switch to the long form
+	f.Add(bytes.Repeat([]byte("a"), 1023), uint16(63), uint32(testMaxPacketSize))
+	f.Add(bytes.Repeat([]byte("a"), 1024), uint16(63), uint32(testMaxPacketSize))
+	f.Add(bytes.Repeat([]byte("a"), 1025), uint16(63), uint32(testMaxPacketSize))
+	// over max packet size
+	f.Add(bytes.Repeat([]byte("a"), 1024), uint16(0), uint32(1023))
+	f.Add(bytes.Repeat([]byte("a"), 2048), uint16(63), uint32(testMaxPacketSize))
+
+	f.Fuzz(func(t *testing.T, chunk []byte, repeat uint16, maxSize uint32) {
+		// repeated to reach long packets, which fuzzing rarely makes
+		data := bytes.Repeat(chunk, int(repeat%64)+1)
+		max := int(maxSize%(2*testMaxPacketSize)) + 1
+
+		var out bytes.Buffer
+		err := NewFrameWriter(&out, max).WriteFrame(data)
+		if len(data) == 0 || len(data) > max {
+			if err == nil {
+				t.Fatalf("packet of %d bytes written with max packet size %d", len(data), max)
+			}
+			if out.Len() != 0 {
+				t.Fatalf("refused packet left %d bytes", out.Len())
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("write packet of %d bytes failed: %s", len(data), err)
+		}
+
+		header := 2
+		if len(data) > 0xFFFF {
+			header = 6
+		}
+		if out.Len() != header+len(data) {
+			t.Fatalf("packet of %d bytes written in %d bytes", len(data), out.Len())
+		}
+
+		r := bytes.NewReader(out.Bytes())
+		buf, err := NewFrameReader(r, max).ReadFrame()
+		if err != nil {
+			t.Fatalf("read packet of %d bytes failed: %s", len(data), err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("packet of %d bytes read as %d bytes", len(data), len(buf))
+		}
+		if _, err = NewFrameReader(r, max).ReadFrame(); err != io.EOF {
+			t.Fatalf("read after the packet returned %v instead of io.EOF", err)
+		}
+
+		// a reader with a smaller limit refuses it
+		if len(data) > 1 {
+			r = bytes.NewReader(out.Bytes())
+			if _, err = NewFrameReader(r, len(data)-1).ReadFrame(); err == nil {
+				t.Fatalf("packet of %d bytes read with max packet size %d", len(data), len(data)-1)
+			}
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/crabkun/crab/config"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// an http-proxy port is an http proxy without authentication, the targets of CONNECT and of
+// requests in absolute uri form are dialed by the server of the port key. a plain request is
+// sent with Connection: close, so every connection carries one request to one target
+
+func clientHandleHttpProxy(remote net.Conn, cfg *config.PortConfig) {
+	l := log.WithFields(log.Fields{
+		"port_mark":   cfg.Mark,
+		"listen_at":   cfg.LocalAddress,
+		"remote_addr": remote.RemoteAddr(),
+	})
+
+	// disconnect if no request in 10s
+	remote.SetDeadline(time.Now().Add(time.Second * 10))
+
+	br := bufio.NewReader(remote)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		l.WithError(err).Debugln("read http proxy request failed")
+		httpProxyReply(remote, http.StatusBadRequest)
+		remote.Close()
+		return
+	}
+
+	target, err := httpProxyTarget(req)
+	if err != nil {
+		l.WithError(err).Debugln("unsupported http proxy request")
+		httpProxyReply(remote, http.StatusBadRequest)
+		remote.Close()
+		return
+	}
+
+	l = l.WithFields(log.Fields{
+		"target": target,
+		"method": req.Method,
+	})
+
+	remote.SetDeadline(time.Time{})
+
+	masterToRemote, remoteToMaster, status := clientDialDynamic(cfg, DynamicNetworkTCP, target, l)
+	if status != DynamicDialSuccess {
+		code := http.StatusBadGateway
+		if status == DynamicDialDenied {
+			code = http.StatusForbidden
+		}
+		httpProxyReply(remote, code)
+		remote.Close()
+		return
+	}
+
+	if req.Method != http.MethodConnect {
+		clientHttpProxyForward(remote, req, masterToRemote, remoteToMaster, l)
+		return
+	}
+
+	_, err = remote.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err == nil && br.Buffered() != 0 {
+		// sent by the client before the reply, e.g. the tls client hello
+		buf, _ := br.Peek(br.Buffered())
+		_, err = remoteToMaster.Write(buf)
+	}
+	if err != nil {
+		l.WithError(err).Debugln("reply http proxy request failed")
+		remote.Close()
+		remoteToMaster.Close()
+		return
+	}
+
+	clientActiveConnections.Inc()
+
+	relayPair(remote, remoteToMaster, masterToRemote, remote, nil, nil, func(up, down RelayResult) {
+		clientActiveConnections.Dec()
+		l.WithFields(log.Fields{
+			"upload":       up.Bytes,
+			"download":     down.Bytes,
+			"upload_end":   up.Cause(),
+			"download_end": down.Cause(),
+		}).Debugln("connection closed")
+	})
+}
+
+// clientHttpProxyForward sends the request to the target and relays the response back. nothing more
+// is read from the client, so that a following request to another target never reaches this one
+func clientHttpProxyForward(remote net.Conn, req *http.Request, masterToRemote io.ReadCloser,
+	remoteToMaster io.WriteCloser, l *log.Entry) {
+	defer func() {
+		remote.Close()
+		masterToRemote.Close()
+		remoteToMaster.Close()
+	}()
+
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	if _, exist := req.Header["User-Agent"]; !exist {
+		// or the default one of go is added
+		req.Header.Set("User-Agent", "")
+	}
+	req.Close = true
+	// written in origin form, the body is read from the client
+	err := req.Write(remoteToMaster)
+	if err != nil {
+		l.WithError(err).Debugln("forward http proxy request failed")
+		return
+	}
+
+	clientActiveConnections.Inc()
+	down := relay(remote, masterToRemote, nil)
+	clientActiveConnections.Dec()
+
+	l.WithFields(log.Fields{
+		"download":     down.Bytes,
+		"download_end": down.Cause(),
+	}).Debugln("connection closed")
+}
+
+// httpProxyTarget is host:port of CONNECT or of a request in absolute uri form
+func httpProxyTarget(req *http.Request) (string, error) {
+	if req.Method == http.MethodConnect {
+		if _, _, err := net.SplitHostPort(req.Host); err != nil {
+			// an ipv6 host is already in brackets
+			return net.JoinHostPort(strings.Trim(req.Host, "[]"), "443"), nil
+		}
+		return req.Host, nil
+	}
+
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		return "", fmt.Errorf("not an absolute http uri: %s", req.RequestURI)
+	}
+	if req.URL.Port() == "" {
+		return net.JoinHostPort(req.URL.Hostname(), "80"), nil
+	}
+	return req.URL.Host, nil
+}
+
+func httpProxyReply(c net.Conn, code int) error {
+	_, err := fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+	return err
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHttpProxyTarget(t *testing.T) {
+	tests := []struct {
+		request string
+		target  string
+		fail    bool
+	}{
+		{"CONNECT example.com:8443 HTTP/1.1\r\nHost: example.com:8443\r\n\r\n", "example.com:8443", false},
+		{"CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com:443", false},
+		{"CONNECT [::1]:8443 HTTP/1.1\r\nHost: [::1]:8443\r\n\r\n", "[::1]:8443", false},
+		{"CONNECT [::1] HTTP/1.1\r\nHost: [::1]\r\n\r\n", "[::1]:443", false},
+		{"GET http://example.com/a?b HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com:80", false},
+		{"GET http://example.com:8080/ HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "example.com:8080", false},
+		{"GET http://[::1]/ HTTP/1.1\r\nHost: [::1]\r\n\r\n", "[::1]:80", false},
+		{"GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n", "", true},
+		{"GET https://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", "", true},
+	}
+	for _, tt := range tests {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tt.request)))
+		if err != nil {
+			t.Fatalf("%q: %s", tt.request, err)
+		}
+		target, err := httpProxyTarget(req)
+		if (err != nil) != tt.fail || target != tt.target {
+			t.Errorf("%q: target %q, error %v", tt.request, target, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/crabkun/crab/config"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"io"
+	"sync"
+	"time"
+)
+
+// limiters shared by all connections of a port key
+type portKeyLimiter struct {
+	Upload   *rate.Limiter
+	Download *rate.Limiter
+}
+
+var portKeyLimiterMap = make(map[string]*portKeyLimiter)
+var portKeyLimiterMapLock sync.Mutex
+
+// masterGetRateLimit prefers the limits kept by the port key store over the master config
+func masterGetRateLimit(portKey string) *config.RateLimitConfig {
+	limit, exist, err := masterStore.RateLimit(portKey)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"port_key": portKey,
+		}).Errorln("get rate limit from port key store failed")
+	}
+	if exist {
+		return limit
+	}
+	return masterConfig.GetRateLimit(portKey)
+}
+
+// masterGetLimiters returns the limiters of upload (client to server) and download (server to client),
+// both per port key and per connection
+func masterGetLimiters(portKey string) (upload []*rate.Limiter, download []*rate.Limiter) {
+	limit := masterGetRateLimit(portKey)
+
+	portKeyLimiterMapLock.Lock()
+	defer portKeyLimiterMapLock.Unlock()
+
+	if limit == nil {
+		delete(portKeyLimiterMap, portKey)
+		return nil, nil
+	}
+
+	shared, exist := portKeyLimiterMap[portKey]
+	if !exist {
+		shared = &portKeyLimiter{}
+		portKeyLimiterMap[portKey] = shared
+	}
+	// limits may be changed since last connection
+	shared.Upload = updateLimiter(shared.Upload, limit.Upload)
+	shared.Download = updateLimiter(shared.Download, limit.Download)
+
+	for _, v := range []*rate.Limiter{shared.Upload, updateLimiter(nil, limit.ConnUpload)} {
+		if v != nil {
+			upload = append(upload, v)
+		}
+	}
+	for _, v := range []*rate.Limiter{shared.Download, updateLimiter(nil, limit.ConnDownload)} {
+		if v != nil {
+			download = append(download, v)
+		}
+	}
+	return upload, download
+}
+
+// updateLimiter returns nil if unlimited
+func updateLimiter(l *rate.Limiter, bytesPerSecond int) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	// the burst must hold a whole limited read
+	burst := bytesPerSecond
+	if burst < LimitedReadSize {
+		burst = LimitedReadSize
+	}
+
+	if l == nil {
+		return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+	}
+	l.SetLimit(rate.Limit(bytesPerSecond))
+	l.SetBurst(burst)
+	return l
+}
+
+// reads of a limited reader are cut to this size, so that a wait never exceeds the burst
+const LimitedReadSize = 4096
+
+type limitedReader struct {
+	r        io.ReadCloser
+	limiters []*rate.Limiter
+}
+
+func newLimitedReader(r io.ReadCloser, limiters []*rate.Limiter) io.ReadCloser {
+	if len(limiters) == 0 {
+		return r
+	}
+	return &limitedReader{
+		r:        r,
+		limiters: limiters,
+	}
+}
+
+func (r *limitedReader) Read(buf []byte) (int, error) {
+	if len(buf) > LimitedReadSize {
+		buf = buf[:LimitedReadSize]
+	}
+	n, err := r.r.Read(buf)
+	for _, v := range r.limiters {
+		if n > 0 {
+			v.WaitN(context.Background(), n)
+		}
+	}
+	return n, err
+}
+
+// SetReadDeadline passes through, so that a limited side of a bridge still idles out once half closed
+func (r *limitedReader) SetReadDeadline(t time.Time) error {
+	d, ok := r.r.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return errors.New("read deadline not supported")
+	}
+	return d.SetReadDeadline(t)
+}
+
+func (r *limitedReader) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"golang.org/x/time/rate"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// a limited bridge half closed by the client is cut once the server idles
+func TestLimitedBridgeHalfClosed(t *testing.T) {
+	defer func(timeout time.Duration) { RelayHalfCloseIdleTimeout = timeout }(RelayHalfCloseIdleTimeout)
+	RelayHalfCloseIdleTimeout = 200 * time.Millisecond
+
+	client, fromClient := tcpPair(t)
+	toServer, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	upload := []*rate.Limiter{updateLimiter(nil, 1<<20)}
+	download := []*rate.Limiter{updateLimiter(nil, 1<<20)}
+	results := make(chan [2]RelayResult, 1)
+	relayPair(newLimitedReader(fromClient, upload), toServer, newLimitedReader(toServer, download), fromClient,
+		nil, nil, func(up, down RelayResult) {
+			results <- [2]RelayResult{up, down}
+		})
+
+	data := []byte("hello crab")
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	closeWrite(client)
+
+	// the server reads the request and its end, then never answers nor closes
+	server.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(data) {
+		t.Fatalf("server read %q", buf)
+	}
+
+	select {
+	case r := <-results:
+		if r[0].Err != nil || r[0].Bytes != int64(len(data)) {
+			t.Fatalf("upload relayed %d bytes, ended by %s", r[0].Bytes, r[0].Cause())
+		}
+		re, ok := r[1].Err.(*relayError)
+		if !ok {
+			t.Fatalf("download ended by %s instead of idling out", r[1].Cause())
+		}
+		if ne, ok := re.Err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("download ended by %s instead of idling out", r[1].Cause())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("half closed bridge not cut after idling")
+	}
+
+	// the client sees the bridge closed
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("client read %v instead of eof", err)
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/crabkun/crab/config"
+	"github.com/crabkun/crab/crypto"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"strings"
@@ -12,15 +14,26 @@ import (
 const VERSION = "beta2"
 
 var (
-	ConfigFile string
+	ConfigFile  string
+	PortKey     string
+	PortKeySalt string
 )
 
 func init() {
 	flag.StringVar(&ConfigFile, "config", "config.json", "config file")
+	flag.StringVar(&PortKey, "port-key-id", "", "print the id of the port key, which is what master knows, and exit")
+	flag.StringVar(&PortKeySalt, "port-key-salt", "", "the port_key_salt of master, used with port-key-id")
 }
 
 func main() {
 	flag.Parse()
+	if PortKey != "" {
+		if PortKeySalt == "" {
+			log.Fatalln("port key salt (port-key-salt) empty")
+		}
+		fmt.Println(crypto.PortKeyId(PortKey, PortKeySalt))
+		return
+	}
 	log.SetFormatter(&log.TextFormatter{
 		DisableTimestamp: false,
 		FullTimestamp:    true,
@@ -56,6 +69,17 @@ func main() {
 	}
 	log.SetLevel(logLvl)
 
+	if baseCfg.MaxPacketSize != 0 {
+		SetMaxPacketSize(baseCfg.MaxPacketSize)
+	}
+	if baseCfg.RelayBufferSize != 0 {
+		SetRelayBufferSize(baseCfg.RelayBufferSize)
+	}
+
+	if baseCfg.MetricsListen != "" {
+		go serveMetrics(baseCfg.MetricsListen, baseCfg.Mode)
+	}
+
 	switch strings.ToLower(baseCfg.Mode) {
 	case "client":
 		var clientConfig *config.ClientConfig
@@ -2,32 +2,118 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"github.com/crabkun/crab/config"
+	"github.com/crabkun/crab/crypto"
+	"github.com/crabkun/crab/store"
+	"github.com/hashicorp/yamux"
 	"github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"math/rand"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var portKeyMap map[string]net.Conn
+var portKeyMap map[string]*portKeyServers
 var portKeyMapLock sync.RWMutex
 
+// servers registered the same port key, more than one only if load balancing is enabled
+type portKeyServers struct {
+	// for round robin, keep it first for atomic alignment
+	next uint64
+	// replaced instead of modified so that it can be used after unlocking
+	Servers []*server
+}
+
 var clientMap map[string]*client
 var clientMapLock sync.Mutex
 
+// connected servers by id
+var serverMap map[string]*server
+var serverMapLock sync.RWMutex
+
+// clients being relayed by client guid
+var sessionMap map[string]*session
+var sessionMapLock sync.RWMutex
+
 type client struct {
+	Conn    net.Conn
+	C       chan int
+	PortKey string
+	Server  *server
+	// another server may be tried if this one fails to connect its local address
+	Retry bool
+	// set before C is closed if the client is left to the next server
+	Retrying bool
+}
+
+type server struct {
+	// bridges being relayed, keep it first for atomic alignment
+	Active int64
+
+	Id string
+	// empty for servers of older versions
+	Name        string
+	ConnectedAt time.Time
+	// zero for servers of older versions
+	Version      uint16
+	Capabilities uint32
+	// control connection
 	Conn net.Conn
-	C    chan int
+	// nil if the server uses callback connections instead of streams
+	Session *yamux.Session
+	// port keys registered by this server, guarded by portKeyMapLock
+	PortKeys map[string]bool
+	// port keys in plain text of a server of an older version by their ids, guarded by portKeyMapLock
+	RawPortKeys map[string]string
+}
+
+// Close disconnects the server, its port keys are unregistered after that
+func (s *server) Close() error {
+	if s.Session != nil {
+		return s.Session.Close()
+	}
+	return s.Conn.Close()
+}
+
+type session struct {
+	// bytes of upload (client to server) and download, keep them first for atomic alignment
+	Upload   int64
+	Download int64
+
+	Id         string
+	PortKey    string
+	ServerName string
+	ClientAddr string
+	StartedAt  time.Time
+
+	clientConn net.Conn
+	serverConn net.Conn
+}
+
+func (s *session) Close() {
+	s.clientConn.Close()
+	s.serverConn.Close()
 }
 
 var masterConfig *config.MasterConfig
+var masterStore store.PortKeyStore
 
 func MasterMain(cfg *config.MasterConfig) {
-	portKeyMap = make(map[string]net.Conn)
+	portKeyMap = make(map[string]*portKeyServers)
 	clientMap = make(map[string]*client)
+	serverMap = make(map[string]*server)
+	sessionMap = make(map[string]*session)
+	peerOutbound = make(map[*peer]bool)
+	peerPortKeyMap = make(map[string]*peer)
 
 	masterConfig = cfg
 
@@ -35,10 +121,54 @@ func MasterMain(cfg *config.MasterConfig) {
 		"listen_at": cfg.ListenAt,
 	})
 
+	if cfg.PortKeySalt == "" {
+		salt, err := newAuthNonce()
+		if err != nil {
+			l.WithError(err).Fatalln("gen port key salt failed")
+		}
+		cfg.PortKeySalt = hex.EncodeToString(salt)
+		l.Warnln("port_key_salt not set, port key ids change on every restart")
+	}
+	localSalt = cfg.PortKeySalt
+	cfg.Index()
+
+	var err error
+	masterStore, err = store.New(cfg.PortKeyStore, cfg.PortKeySalt)
+	if err != nil {
+		l.WithError(err).Fatalln("init port key store failed")
+	}
+
+	if cfg.Admin != nil {
+		go serveAdmin(cfg.Admin)
+	}
+
+	if len(cfg.Peers) != 0 {
+		err = masterStartPeers(cfg)
+		if err != nil {
+			l.WithError(err).Fatalln("start peers failed")
+		}
+	}
+
+	if cfg.QuotaStateFile != "" {
+		err = masterLoadTrafficCounters(cfg.QuotaStateFile)
+		if err != nil {
+			l.WithError(err).Fatalln("load traffic counters failed")
+		}
+		go masterPersistTrafficCounters(cfg.QuotaStateFile)
+	}
+	go masterRollTrafficCounters()
+
 	listener, err := net.Listen("tcp", cfg.ListenAt)
 	if err != nil {
 		l.WithError(err).Fatalln("listen failed")
 	}
+	if cfg.TLS != nil {
+		tlsConfig, err := cfg.TLS.MasterTLSConfig()
+		if err != nil {
+			l.WithError(err).Fatalln("load tls config failed")
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 
 	l.Infoln("master running...")
 
@@ -72,36 +202,119 @@ func masterHandleNewConn(conn net.Conn) {
 	l.Debugln("new connection coming")
 
 	// waiting handshake
-	buf, err := ReadFromSocket(conn)
+	buf, err := ReadHandshakeFromSocket(conn)
 	if err != nil {
 		l.WithError(err).Debugln("read handshake failed")
 		return
 	}
+
+	// sides of older versions start with the handshake directly
+	remote := legacyHello()
+	if buf[0] == CommandHello {
+		remote, err = parseHello(buf[1:])
+		if err != nil {
+			l.WithError(err).Debugln("parse hello failed")
+			return
+		}
+		if Response(conn, ResponseCodeHello, localHello().Marshal()) != nil {
+			return
+		}
+		remote.Capabilities &= LocalCapabilities
+
+		buf, err = ReadHandshakeFromSocket(conn)
+		if err != nil {
+			l.WithError(err).Debugln("read handshake failed")
+			return
+		}
+	}
 	command := buf[0]
 	buf = buf[1:]
 
+	// a side saying hello uses only what it has
+	var capability uint32
+	switch command {
+	case CommandClientMuxHandshake:
+		capability = CapabilityMux
+	case CommandServerAuthHandshake:
+		capability = CapabilityAuth
+	case CommandPeerHandshake:
+		capability = CapabilityPeer
+	}
+	if capability != 0 && !remote.Has(capability) {
+		l.WithFields(log.Fields{
+			"command": int(command),
+		}).Debugln("handshake without the capability")
+		return
+	}
+
 	switch command {
 	case CommandServerHandshake:
 		if len(buf) == 0 {
 			return
 		}
+		if !masterConfig.AllowPlainAuth {
+			l.Warnln("server sent master key in plain text, set allow_plain_auth to accept it")
+			masterResponseFailure(conn, ResponseCodeMasterKeyMismatch, nil)
+			return
+		}
 
 		// cancel handshake deadline
 		conn.SetDeadline(time.Time{})
 		ok = true
 
-		go masterHandleServer(conn, buf)
+		go masterHandleServer(conn, buf, remote)
+		return
+	case CommandServerAuthHandshake:
+		if len(buf) < AuthNonceSize {
+			return
+		}
+
+		// the handshake deadline is canceled after the challenge is answered
+		ok = true
+
+		go masterHandleAuthServer(conn, buf, remote)
 		return
 	case CommandClientHandshake:
 		if len(buf) == 0 {
 			return
 		}
 
+		// clients of older versions send the port key itself
+		portKey := string(buf)
+		if remote.Version == 0 {
+			portKey = crypto.PortKeyId(portKey, masterConfig.PortKeySalt)
+		}
+
+		// cancel handshake deadline
+		conn.SetDeadline(time.Time{})
+		ok = true
+
+		go masterConnectPortKey(conn, portKey, false)
+		return
+	case CommandPeerHandshake:
+		if len(buf) < AuthNonceSize {
+			return
+		}
+		if len(masterConfig.Peers) == 0 {
+			l.Debugln("peer connection refused, no peer configured")
+			return
+		}
+		if remote.Salt != masterConfig.PortKeySalt {
+			l.Warnln("peer connection refused, it has a different port key salt (port_key_salt)")
+			return
+		}
+
+		// the handshake deadline is canceled after the challenge is answered
+		ok = true
+
+		go masterHandlePeer(conn, buf[:AuthNonceSize])
+		return
+	case CommandClientMuxHandshake:
 		// cancel handshake deadline
 		conn.SetDeadline(time.Time{})
 		ok = true
 
-		go masterConnectPortKey(conn, string(buf))
+		go masterHandleMuxClient(conn)
 		return
 	case CommandServerAcceptClientRequest:
 		if len(buf) == 0 {
@@ -119,14 +332,142 @@ func masterHandleNewConn(conn net.Conn) {
 	}
 }
 
-func masterHandleServer(conn net.Conn, masterKeyBuf []byte) {
+// masterHandleMuxClient serves a client that carries all its connections as streams of one session,
+// every stream starts with its own client handshake
+func masterHandleMuxClient(conn net.Conn) {
+	l := log.WithFields(log.Fields{
+		"remote_addr": conn.RemoteAddr(),
+		"remote_type": "client",
+	})
+
+	if Response(conn, ResponseCodeReady, nil) != nil {
+		conn.Close()
+		return
+	}
+
+	session, err := yamux.Server(conn, newMuxConfig())
+	if err != nil {
+		l.WithError(err).Errorln("init mux session failed")
+		conn.Close()
+		return
+	}
+	defer session.Close()
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			l.Debugln("client session closed")
+			return
+		}
+
+		go masterHandleClientStream(stream, false)
+	}
+}
+
+// masterHandleClientStream serves a stream of a client, or of a peer forwarding its client to us
+func masterHandleClientStream(stream net.Conn, forwarded bool) {
+	// disconnect if not handshake in 3s
+	stream.SetDeadline(time.Now().Add(time.Second * 3))
+
+	buf, err := ReadHandshakeFromSocket(stream)
+	if err != nil || buf[0] != CommandClientHandshake || len(buf) == 1 {
+		stream.Close()
+		return
+	}
+
+	// cancel handshake deadline
+	stream.SetDeadline(time.Time{})
+
+	masterConnectPortKey(stream, string(buf[1:]), forwarded)
+}
+
+// masterHandleAuthServer challenges the server to prove it knows the master key,
+// proving the same to the server at the same time
+func masterHandleAuthServer(conn net.Conn, buf []byte, remote *hello) {
+	serverNonce := buf[:AuthNonceSize]
+	name := string(buf[AuthNonceSize:])
+
 	l := log.WithFields(log.Fields{
 		"remote_addr": conn.RemoteAddr(),
 		"remote_type": "server",
+		"server_name": name,
 	})
 
-	if string(masterKeyBuf) != masterConfig.MasterKey {
-		Response(conn, ResponseCodeMasterKeyMismatch, nil)
+	key, ok, err := masterServerKey(name)
+	if err == errServerKeyLookupLimited {
+		l.Debugln("server key lookup rate limited")
+		conn.Close()
+		return
+	}
+	if err != nil {
+		l.WithError(err).Errorln("get server key from port key store failed")
+		conn.Close()
+		return
+	}
+	if !ok {
+		key = masterConfig.MasterKey
+	}
+
+	if !masterAuthChallenge(conn, l, key, "server", serverNonce) {
+		conn.Close()
+		return
+	}
+
+	// cancel handshake deadline
+	conn.SetDeadline(time.Time{})
+
+	masterServeServer(conn, true, name, remote)
+}
+
+// masterAuthChallenge checks that the remote side of the role knows the key and then proves
+// the same to it. the remote side proves first, so that nobody gets a proof of master to
+// brute force the key offline without knowing the key
+func masterAuthChallenge(conn net.Conn, l *log.Entry, key string, role string, remoteNonce []byte) bool {
+	masterNonce, err := newAuthNonce()
+	if err != nil {
+		l.WithError(err).Errorln("gen auth nonce failed")
+		return false
+	}
+
+	if Response(conn, ResponseCodeAuthChallenge, masterNonce) != nil {
+		return false
+	}
+
+	resp, err := ReadHandshakeFromSocket(conn)
+	if err != nil || resp[0] != CommandServerAuthResponse {
+		return false
+	}
+	if !hmac.Equal(resp[1:], authProof(key, masterConfig.PortKeySalt, role, masterNonce, remoteNonce)) {
+		masterResponseFailure(conn, ResponseCodeMasterKeyMismatch, nil)
+		return false
+	}
+
+	return Response(conn, ResponseCodeAuthProof, authProof(key, masterConfig.PortKeySalt, "master", remoteNonce, masterNonce)) == nil
+}
+
+// masterHandleServer serves a server of an older version, which sends the master key in plain text
+// and is asked to call back for every client
+func masterHandleServer(conn net.Conn, masterKeyBuf []byte, remote *hello) {
+	if subtle.ConstantTimeCompare(masterKeyBuf, []byte(masterConfig.MasterKey)) != 1 {
+		masterResponseFailure(conn, ResponseCodeMasterKeyMismatch, nil)
+		conn.Close()
+		return
+	}
+
+	masterServeServer(conn, false, "", remote)
+}
+
+// masterServeServer serves an authenticated server until it disconnected
+func masterServeServer(conn net.Conn, mux bool, name string, remote *hello) {
+	l := log.WithFields(log.Fields{
+		"remote_addr": conn.RemoteAddr(),
+		"remote_type": "server",
+		"server_name": name,
+	})
+
+	if masterConfig.TLS != nil && masterConfig.TLS.RequireServerCert && !hasVerifiedCert(conn) {
+		l.Debugln("server has no verified certificate")
+		masterResponseFailure(conn, ResponseCodeServerCertRequired, nil)
 		conn.Close()
 		return
 	}
@@ -134,22 +475,76 @@ func masterHandleServer(conn net.Conn, masterKeyBuf []byte) {
 		conn.Close()
 		return
 	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		l.WithError(err).Errorln("gen uuid failed")
+		conn.Close()
+		return
+	}
+
+	thisServer := &server{
+		Id:           id.String(),
+		Name:         name,
+		ConnectedAt:  time.Now(),
+		Version:      remote.Version,
+		Capabilities: remote.Capabilities,
+		Conn:         conn,
+		PortKeys:     make(map[string]bool),
+		RawPortKeys:  make(map[string]string),
+	}
+	if mux {
+		// the server opens the control stream right after handshake,
+		// every client will be carried by a new stream of this session
+		session, err := yamux.Server(conn, newMuxConfig())
+		if err != nil {
+			l.WithError(err).Errorln("init mux session failed")
+			conn.Close()
+			return
+		}
+		control, err := session.Accept()
+		if err != nil {
+			l.WithError(err).Debugln("accept control stream failed")
+			session.Close()
+			return
+		}
+		thisServer.Conn = control
+		thisServer.Session = session
+	}
+
+	serverMapLock.Lock()
+	serverMap[thisServer.Id] = thisServer
+	serverMapLock.Unlock()
+
 	defer func() {
+		serverMapLock.Lock()
+		delete(serverMap, thisServer.Id)
+		serverMapLock.Unlock()
+
 		// unregister port key after server disconnected
-		// todo optimize
 		portKeyMapLock.Lock()
-		for k, v := range portKeyMap {
-			if v.RemoteAddr() == conn.RemoteAddr() {
-				delete(portKeyMap, k)
-			}
+		for k := range thisServer.PortKeys {
+			masterRemoveServerPortKey(thisServer, k)
 		}
+		thisServer.PortKeys = nil
 		conn.Close()
 		portKeyMapLock.Unlock()
 	}()
+	if thisServer.Session != nil {
+		defer thisServer.Session.Close()
+	}
+	// servers without heartbeat never ping, they are not timed out.
+	// servers of older versions have it if they ever ping
+	heartbeat := thisServer.Capabilities&CapabilityHeartbeat != 0
 	for {
-		packet, err := ReadFromSocket(conn)
+		if heartbeat {
+			thisServer.Conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(masterConfig.HeartbeatTimeout)))
+		}
+		packet, err := ReadFromSocket(thisServer.Conn)
 		if err != nil {
-			if err != io.EOF {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				l.Warnln("server heartbeat timeout, unregistering its port keys")
+			} else if err != io.EOF {
 				l.WithError(err).Debugln("read server packet failed")
 			} else {
 				l.Debugln("server disconnected")
@@ -165,8 +560,31 @@ func masterHandleServer(conn net.Conn, masterKeyBuf []byte) {
 			if len(packet) == 0 {
 				return
 			}
-			code := masterRegisterPortKey(conn, string(packet))
-			err = Response(conn, code, packet)
+			code := masterRegisterPortKey(thisServer, masterServerPortKey(thisServer, packet))
+			if code == ResponseCodePortKeyRegSuccess {
+				err = Response(thisServer.Conn, code, packet)
+			} else {
+				err = masterResponseFailure(thisServer.Conn, code, packet)
+			}
+			if err != nil {
+				return
+			}
+		case CommandServerPing:
+			heartbeat = true
+			err = Response(thisServer.Conn, ResponseCodePong, nil)
+			if err != nil {
+				return
+			}
+		case CommandServerUnregisterPortKey:
+			if len(packet) == 0 {
+				return
+			}
+			code := masterUnregisterPortKey(thisServer, masterServerPortKey(thisServer, packet))
+			if code == ResponseCodePortKeyUnregSuccess {
+				err = Response(thisServer.Conn, code, packet)
+			} else {
+				err = masterResponseFailure(thisServer.Conn, code, packet)
+			}
 			if err != nil {
 				return
 			}
@@ -188,11 +606,15 @@ func masterHandleServer(conn net.Conn, masterKeyBuf []byte) {
 
 			// delete client and close the timeout waiting channel
 			delete(clientMap, clientGuid)
+			thisClient.Retrying = thisClient.Retry && reason == RejectCodePortKeyRemoteConnectFailed
 			close(thisClient.C)
 
 			clientMapLock.Unlock()
 
-			Response(thisClient.Conn, ResponseCodeServerRejectClient, []byte{reason})
+			if thisClient.Retrying {
+				continue
+			}
+			masterResponseFailure(thisClient.Conn, ResponseCodeServerRejectClient, []byte{reason})
 			thisClient.Conn.Close()
 		default:
 			// unsupported command
@@ -201,61 +623,269 @@ func masterHandleServer(conn net.Conn, masterKeyBuf []byte) {
 	}
 }
 
-func masterRegisterPortKey(c net.Conn, portKey string) uint8 {
+// masterServerPortKey normalises the port key sent by the server to its id, servers of older versions
+// send the port key itself, which is remembered to call them back with it
+func masterServerPortKey(s *server, packet []byte) string {
+	if s.Version != 0 {
+		return string(packet)
+	}
+	id := crypto.PortKeyId(string(packet), masterConfig.PortKeySalt)
+	portKeyMapLock.Lock()
+	s.RawPortKeys[id] = string(packet)
+	portKeyMapLock.Unlock()
+	return id
+}
+
+// masterUnregisterPortKey removes the port key if it is registered by this server,
+// bridges already established are not affected
+func masterUnregisterPortKey(s *server, portKey string) uint8 {
+	l := log.WithFields(log.Fields{
+		"remote_addr": s.Conn.RemoteAddr(),
+		"server_name": s.Name,
+		"port_key":    portKey,
+	})
+
 	portKeyMapLock.Lock()
 	defer portKeyMapLock.Unlock()
 
 	_, exist := portKeyMap[portKey]
-	if exist {
-		return ResponseCodePortKeyExist
+	if !exist {
+		return ResponseCodePortKeyNotExist
+	}
+	if !s.PortKeys[portKey] {
+		return ResponseCodePortKeyNotOwned
+	}
+
+	masterRemoveServerPortKey(s, portKey)
+	l.Debugln("port key unregister success")
+	return ResponseCodePortKeyUnregSuccess
+}
+
+// masterRemoveServerPortKey removes the server from the servers of the port key and
+// the port key from the index of the server, portKeyMapLock must be held
+func masterRemoveServerPortKey(s *server, portKey string) {
+	delete(s.PortKeys, portKey)
+
+	entry, exist := portKeyMap[portKey]
+	if !exist {
+		return
+	}
+	for i, v := range entry.Servers {
+		if v == s {
+			entry.Servers = append(entry.Servers[:i:i], entry.Servers[i+1:]...)
+			break
+		}
 	}
+	if len(entry.Servers) == 0 {
+		delete(portKeyMap, portKey)
+		masterNotifyPeers(CommandPeerPortKeyRemove, portKey)
+	}
+}
+
+// masterRemovePortKey deletes the port key from portKeyMap and the index of its servers,
+// portKeyMapLock must be held
+func masterRemovePortKey(portKey string) bool {
+	entry, exist := portKeyMap[portKey]
+	if !exist {
+		return false
+	}
+	for _, v := range entry.Servers {
+		delete(v.PortKeys, portKey)
+	}
+	delete(portKeyMap, portKey)
+	masterNotifyPeers(CommandPeerPortKeyRemove, portKey)
+	return true
+}
+
+func hasVerifiedCert(conn net.Conn) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	return len(tlsConn.ConnectionState().VerifiedChains) > 0
+}
 
-	portKeyMap[portKey] = c
-	log.WithFields(log.Fields{
-		"remote_addr": c.RemoteAddr(),
+func masterRegisterPortKey(s *server, portKey string) uint8 {
+	l := log.WithFields(log.Fields{
+		"remote_addr": s.Conn.RemoteAddr(),
+		"server_name": s.Name,
 		"port_key":    portKey,
-	}).Debugln("new port key register success")
+	})
+
+	allow, err := masterStore.AllowRegister(s.Name, portKey)
+	if err != nil {
+		l.WithError(err).Errorln("check port key register in port key store failed")
+		return ResponseCodePortKeyRegDenied
+	}
+	if !allow {
+		l.Debugln("port key store denied port key register")
+		return ResponseCodePortKeyRegDenied
+	}
+
+	// a new port key is claimed from the peers first
+	claimed := false
+	portKeyMapLock.Lock()
+	for {
+		if _, exist := portKeyMap[portKey]; exist || claimed {
+			break
+		}
+		portKeyMapLock.Unlock()
+		if !masterClaimPortKey(portKey) {
+			l.Debugln("port key claimed by a peer")
+			return ResponseCodePortKeyExist
+		}
+		claimed = true
+		portKeyMapLock.Lock()
+	}
+	defer portKeyMapLock.Unlock()
+
+	entry, exist := portKeyMap[portKey]
+	if exist && (masterConfig.LoadBalance == "" || s.PortKeys[portKey]) {
+		return ResponseCodePortKeyExist
+	}
+	if !exist && masterPeerHasPortKey(portKey) {
+		if claimed {
+			// give back the claim, the port key went to a peer meanwhile
+			masterNotifyPeers(CommandPeerPortKeyRemove, portKey)
+		}
+		return ResponseCodePortKeyExist
+	}
+
+	if !exist {
+		entry = &portKeyServers{}
+		portKeyMap[portKey] = entry
+		masterNotifyPeers(CommandPeerPortKeyAdd, portKey)
+	}
+	entry.Servers = append(entry.Servers[:len(entry.Servers):len(entry.Servers)], s)
+	s.PortKeys[portKey] = true
+	l.Debugln("new port key register success")
 	return ResponseCodePortKeyRegSuccess
 }
 
-func masterConnectPortKey(conn net.Conn, portKey string) {
+// masterConnectPortKey connects the client to the server of the port key,
+// forwarded clients come from a peer which has checked them with their real address
+func masterConnectPortKey(conn net.Conn, portKey string, forwarded bool) {
 	l := log.WithFields(log.Fields{
 		"remote_addr": conn.RemoteAddr(),
 		"remote_type": "client",
 	})
 
+	if !forwarded {
+		allow, err := masterStore.AllowConnect(portKey, conn.RemoteAddr().String())
+		if err != nil {
+			l.WithError(err).Errorln("check client connect in port key store failed")
+		}
+		if !allow {
+			masterResponseFailure(conn, ResponseCodePortKeyConnectDenied, []byte(portKey))
+			conn.Close()
+			return
+		}
+	}
+
 	// find port key
 	portKeyMapLock.RLock()
-	server, exist := portKeyMap[portKey]
+	entry, exist := portKeyMap[portKey]
 	if !exist {
 		portKeyMapLock.RUnlock()
-		Response(conn, ResponseCodePortKeyNotExist, []byte(portKey))
+		if !forwarded && masterForwardToPeer(conn, portKey) {
+			return
+		}
+		masterResponseFailure(conn, ResponseCodePortKeyNotExist, []byte(portKey))
 		conn.Close()
 		return
 	}
+	servers := masterPickServers(entry)
 	portKeyMapLock.RUnlock()
 
-	// gen guid for client
-	guid, err := uuid.NewV4()
-	if err != nil {
-		l.WithError(err).Errorln("gen uuid failed")
+	// servers with traffic quota left
+	available := servers[:0:0]
+	for _, v := range servers {
+		if !masterQuotaExceeded(portKey, v.Name) {
+			available = append(available, v)
+		}
+	}
+	if len(available) == 0 {
+		l.WithFields(log.Fields{
+			"port_key": portKey,
+		}).Debugln("traffic quota exceeded")
+		masterResponseFailure(conn, ResponseCodeQuotaExceeded, []byte(portKey))
 		conn.Close()
 		return
 	}
-	guidStr := guid.String()
 
+	for i, thisServer := range available {
+		// gen guid for client
+		guid, err := uuid.NewV4()
+		if err != nil {
+			l.WithError(err).Errorln("gen uuid failed")
+			conn.Close()
+			return
+		}
+		guidStr := guid.String()
+
+		// try the next server if this one failed to connect its local address
+		last := i == len(available)-1
+		var done bool
+		if thisServer.Session == nil {
+			done = masterConnectCallback(conn, thisServer, portKey, guidStr, !last)
+		} else {
+			done = masterConnectStream(conn, thisServer, portKey, guidStr, !last)
+		}
+		if done {
+			return
+		}
+		l.WithFields(log.Fields{
+			"port_key":    portKey,
+			"server_name": thisServer.Name,
+		}).Debugln("connect through server failed, retrying another server")
+	}
+}
+
+// masterPickServers orders the servers of the port key by the load balancing strategy,
+// the first one is tried first and the others are retried in turn, portKeyMapLock must be held
+func masterPickServers(entry *portKeyServers) []*server {
+	servers := entry.Servers
+	if len(servers) <= 1 {
+		return servers
+	}
+
+	result := make([]*server, 0, len(servers))
+	switch masterConfig.LoadBalance {
+	case config.LoadBalanceLeastConnections:
+		result = append(result, servers...)
+		sort.SliceStable(result, func(i, j int) bool {
+			return atomic.LoadInt64(&result[i].Active) < atomic.LoadInt64(&result[j].Active)
+		})
+	case config.LoadBalanceRandom:
+		for _, i := range rand.Perm(len(servers)) {
+			result = append(result, servers[i])
+		}
+	default:
+		start := int(atomic.AddUint64(&entry.next, 1) % uint64(len(servers)))
+		result = append(result, servers[start:]...)
+		result = append(result, servers[:start]...)
+	}
+	return result
+}
+
+// masterConnectCallback asks a server of older versions to connect local address
+// and callback to master with the client guid, it returns like masterConnectStream
+func masterConnectCallback(conn net.Conn, thisServer *server, portKey string, guidStr string, retry bool) bool {
 	clientMapLock.Lock()
 	// todo delete this ?
-	_, exist = clientMap[guidStr]
+	_, exist := clientMap[guidStr]
 	if exist {
 		clientMapLock.Unlock()
 		conn.Close()
-		return
+		return true
 	}
 
 	thisClient := &client{
-		Conn: conn,
-		C:    make(chan int),
+		Conn:    conn,
+		C:       make(chan int),
+		PortKey: portKey,
+		Server:  thisServer,
+		Retry:   retry,
 	}
 	clientMap[guidStr] = thisClient
 	clientMapLock.Unlock()
@@ -264,36 +894,126 @@ func masterConnectPortKey(conn net.Conn, portKey string) {
 	defer func() {
 		if !ok {
 			conn.Close()
-
-			clientMapLock.Lock()
-			delete(clientMap, guidStr)
-			clientMapLock.Unlock()
 		}
+
+		clientMapLock.Lock()
+		delete(clientMap, guidStr)
+		clientMapLock.Unlock()
 	}()
 
-	buf := bytes.NewBuffer(nil)
-	binary.Write(buf, binary.BigEndian, uint8(len(portKey)))
-	buf.WriteString(portKey)
-	buf.WriteString(guidStr)
+	// servers of older versions only know the port key itself
+	portKeyMapLock.RLock()
+	rawPortKey, exist := thisServer.RawPortKeys[portKey]
+	portKeyMapLock.RUnlock()
+	if !exist {
+		rawPortKey = portKey
+	}
 
 	// tell server to connect local addres and callback to master with client guid
-	err = Response(server, ResponseCodeNewClientComing, buf.Bytes())
+	err := Response(thisServer.Conn, ResponseCodeNewClientComing, newClientComingPacket(rawPortKey, guidStr))
 	if err != nil {
-		return
+		ok = retry
+		return false
 	}
 
 	// waiting server to connect local address
 	select {
 	case <-time.After(time.Second * 10):
 		// oops, timeout
-		Response(conn, ResponseCodePortKeyConnectTimeout, nil)
-		return
+		masterMatchTimeouts.Inc()
+		masterResponseFailure(conn, ResponseCodePortKeyConnectTimeout, nil)
+		return true
 	case <-thisClient.C:
 		// ok = true is not meant server accept the client, maybe reject
 		ok = true
-		return
+		// the client is kept for the next server
+		return !thisClient.Retrying
+	}
+}
+
+// masterConnectStream asks a multiplexing server to connect local address through a new stream,
+// the stream is bridged with client directly so no callback connection is needed.
+// if retry is set and the server failed to connect its local address, false is returned
+// and the client is left untouched for another server
+func masterConnectStream(conn net.Conn, thisServer *server, portKey string, guid string, retry bool) bool {
+	l := log.WithFields(log.Fields{
+		"remote_addr": conn.RemoteAddr(),
+		"remote_type": "client",
+		"client_guid": guid,
+	})
+
+	ok := false
+	defer func() {
+		if !ok {
+			conn.Close()
+		}
+	}()
+
+	stream, err := thisServer.Session.Open()
+	if err != nil {
+		l.WithError(err).Debugln("open stream to server failed")
+		ok = retry
+		return false
+	}
+	defer func() {
+		if !ok {
+			stream.Close()
+		}
+	}()
+
+	// waiting server to connect local address
+	stream.SetDeadline(time.Now().Add(time.Second * 10))
+
+	err = Response(stream, ResponseCodeNewClientComing, newClientComingPacket(portKey, guid))
+	if err != nil {
+		ok = retry
+		return false
+	}
+
+	packet, err := ReadFromSocket(stream)
+	if err != nil {
+		if ne, isNetErr := err.(net.Error); isNetErr && ne.Timeout() {
+			// oops, timeout
+			masterMatchTimeouts.Inc()
+			masterResponseFailure(conn, ResponseCodePortKeyConnectTimeout, nil)
+		}
+		return true
+	}
+
+	switch packet[0] {
+	case CommandServerAcceptClientRequest:
+		stream.SetDeadline(time.Time{})
+
+		err = Response(conn, ResponseCodeServerAcceptClient, nil)
+		if err != nil {
+			return true
+		}
+
+		ok = true
+
+		masterBridge(conn, stream, guid, portKey, thisServer)
+	case CommandServerRejectClientRequest:
+		if len(packet) < 2 {
+			return true
+		}
+		if retry && packet[1] == RejectCodePortKeyRemoteConnectFailed {
+			stream.Close()
+			// the client is kept for the next server
+			ok = true
+			return false
+		}
+		// reject reason
+		masterResponseFailure(conn, ResponseCodeServerRejectClient, packet[1:2])
 	}
+	return true
+}
 
+func newClientComingPacket(portKey string, guid string) []byte {
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.BigEndian, uint8(len(portKey)))
+	buf.WriteString(portKey)
+	buf.WriteString(guid)
+	return buf.Bytes()
 }
 
 func masterMatchClient(c net.Conn, clientGuid string) {
@@ -322,7 +1042,52 @@ func masterMatchClient(c net.Conn, clientGuid string) {
 
 	ok = true
 
-	// tcp bridge
-	go tcpBridge(thisClient.Conn, c)
-	go tcpBridge(c, thisClient.Conn)
+	masterBridge(thisClient.Conn, c, clientGuid, thisClient.PortKey, thisClient.Server)
+}
+
+// masterBridge relays traffic between a client and the server it matched
+func masterBridge(clientConn net.Conn, serverConn net.Conn, guid string, portKey string, thisServer *server) {
+	upload, download := masterGetLimiters(portKey)
+	serverName := thisServer.Name
+
+	thisSession := &session{
+		Id:         guid,
+		PortKey:    portKey,
+		ServerName: serverName,
+		ClientAddr: clientConn.RemoteAddr().String(),
+		StartedAt:  time.Now(),
+		clientConn: clientConn,
+		serverConn: serverConn,
+	}
+
+	l := log.WithFields(log.Fields{
+		"client_guid": guid,
+		"port_key":    portKey,
+		"server_name": serverName,
+	})
+
+	sessionMapLock.Lock()
+	sessionMap[guid] = thisSession
+	sessionMapLock.Unlock()
+	masterActiveBridges.Inc()
+	atomic.AddInt64(&thisServer.Active, 1)
+
+	// plain tcp connections without rate limit are spliced
+	relayPair(newLimitedReader(clientConn, upload), serverConn, newLimitedReader(serverConn, download), clientConn,
+		masterTrafficCounter(portKey, serverName, "upload", &thisSession.Upload),
+		masterTrafficCounter(portKey, serverName, "download", &thisSession.Download),
+		func(up, down RelayResult) {
+			sessionMapLock.Lock()
+			delete(sessionMap, guid)
+			sessionMapLock.Unlock()
+			masterActiveBridges.Dec()
+			atomic.AddInt64(&thisServer.Active, -1)
+
+			l.WithFields(log.Fields{
+				"upload":       up.Bytes,
+				"download":     down.Bytes,
+				"upload_end":   up.Cause(),
+				"download_end": down.Cause(),
+			}).Debugln("bridge closed")
+		})
 }
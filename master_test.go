@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"github.com/crabkun/crab/config"
+	"github.com/crabkun/crab/crypto"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testMasterKey = "test master key"
+const testPortKeySalt = "test salt"
+
+var testMasterAddr string
+var testMasterOnce sync.Once
+
+// startTestMaster runs the master once for all tests, it accepts servers of older versions
+func startTestMaster(t *testing.T) string {
+	testMasterOnce.Do(func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		testMasterAddr = l.Addr().String()
+		l.Close()
+
+		cfg := &config.MasterConfig{
+			ListenAt:       testMasterAddr,
+			MasterKey:      testMasterKey,
+			PortKeySalt:    testPortKeySalt,
+			AllowPlainAuth: true,
+			LoadBalance:    config.LoadBalanceRoundRobin,
+		}
+		if err = cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		go MasterMain(cfg)
+
+		for i := 0; i < 100; i++ {
+			c, err := net.Dial("tcp", testMasterAddr)
+			if err == nil {
+				c.Close()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("master not started")
+	})
+	return testMasterAddr
+}
+
+func startEchoBackend(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func testPortConfig(portKey string, localAddress string) *config.PortConfig {
+	return &config.PortConfig{
+		Mark:           portKey,
+		LocalAddress:   localAddress,
+		PortKey:        portKey,
+		EncryptMethod:  "plain",
+		CompressMethod: "null",
+	}
+}
+
+func waitPortKey(t *testing.T, id string) {
+	for i := 0; i < 100; i++ {
+		portKeyMapLock.RLock()
+		_, exist := portKeyMap[id]
+		portKeyMapLock.RUnlock()
+		if exist {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("port key %s not registered", id)
+}
+
+// legacyServe is a server of an older version: it sends the master key and the port key in plain text
+// and calls back for every client, the clients are echoed. a failing one rejects them as if its
+// local address could not be connected
+func legacyServe(t *testing.T, addr string, portKey string, failing bool) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	SendCommand(c, CommandServerHandshake, []byte(testMasterKey))
+	buf, err := ReadFromSocket(c)
+	if err != nil || buf[0] != ResponseCodeReady {
+		t.Fatalf("legacy server handshake failed: %v %v", err, buf)
+	}
+	SendCommand(c, CommandServerRegisterPortKey, []byte(portKey))
+	buf, err = ReadFromSocket(c)
+	if err != nil || buf[0] != ResponseCodePortKeyRegSuccess || string(buf[1:]) != portKey {
+		t.Fatalf("legacy server register failed: %v %q", err, buf)
+	}
+
+	go func() {
+		for {
+			buf, err := ReadFromSocket(c)
+			if err != nil {
+				return
+			}
+			if buf[0] != ResponseCodeNewClientComing {
+				continue
+			}
+			n := int(buf[1])
+			if string(buf[2:2+n]) != portKey {
+				t.Errorf("legacy server called with port key %q", buf[2:2+n])
+				continue
+			}
+			guid := buf[2+n:]
+
+			if failing {
+				SendCommand(c, CommandServerRejectClientRequest,
+					append([]byte{RejectCodePortKeyRemoteConnectFailed}, guid...))
+				continue
+			}
+
+			callback, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			SendCommand(callback, CommandServerAcceptClientRequest, guid)
+			go func() {
+				io.Copy(callback, callback)
+				callback.Close()
+			}()
+		}
+	}()
+}
+
+// legacyConnect is a client of an older version, which sends the port key in plain text
+func legacyConnect(t *testing.T, addr string, portKey string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SendCommand(c, CommandClientHandshake, []byte(portKey))
+	buf, err := ReadFromSocket(c)
+	if err != nil || buf[0] != ResponseCodeServerAcceptClient {
+		c.Close()
+		t.Fatalf("legacy client handshake failed: %v %v", err, buf)
+	}
+	return c
+}
+
+func newConnect(t *testing.T, addr string, portCfg *config.PortConfig) net.Conn {
+	clientConfig = &config.ClientConfig{
+		Master:      addr,
+		MuxSessions: 1,
+	}
+	clientSessions = []*clientSession{{}}
+	c, ok := clientMatchServer(portCfg, log.WithField("port_mark", portCfg.Mark))
+	if !ok {
+		t.Fatal("client match server failed")
+	}
+	return c
+}
+
+func newServe(t *testing.T, addr string, portCfg *config.PortConfig) {
+	cfg := &config.ServerConfig{
+		Master:    config.Addresses{addr},
+		MasterKey: testMasterKey,
+		Ports:     []*config.PortConfig{portCfg},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	serverConfig = cfg
+	serverPools = serverBuildPools(cfg.Ports, nil)
+
+	session, control, err := serverConnectMaster(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	go serverServeControl(log.WithField("master", addr), addr, session, control)
+}
+
+func testEcho(t *testing.T, c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+	data := []byte("hello crab")
+	_, err := c.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("echoed %q", buf)
+	}
+}
+
+// sides of older versions send the port key in plain text and newer ones send its id,
+// master matches them by the id
+func TestMasterMixedVersions(t *testing.T) {
+	addr := startTestMaster(t)
+
+	t.Run("legacy server and new client", func(t *testing.T) {
+		portCfg := testPortConfig("legacy server port key", "")
+		legacyServe(t, addr, portCfg.PortKey, false)
+		waitPortKey(t, crypto.PortKeyId(portCfg.PortKey, testPortKeySalt))
+
+		testEcho(t, newConnect(t, addr, portCfg))
+	})
+
+	t.Run("new server and legacy client", func(t *testing.T) {
+		portCfg := testPortConfig("new server port key", startEchoBackend(t))
+		newServe(t, addr, portCfg)
+		waitPortKey(t, crypto.PortKeyId(portCfg.PortKey, testPortKeySalt))
+
+		testEcho(t, legacyConnect(t, addr, portCfg.PortKey))
+	})
+
+	t.Run("failing legacy server retried", func(t *testing.T) {
+		portCfg := testPortConfig("failing legacy server port key", "")
+		legacyServe(t, addr, portCfg.PortKey, true)
+		waitPortKey(t, crypto.PortKeyId(portCfg.PortKey, testPortKeySalt))
+		legacyServe(t, addr, portCfg.PortKey, false)
+
+		// either server comes first in turn
+		for i := 0; i < 4; i++ {
+			testEcho(t, legacyConnect(t, addr, portCfg.PortKey))
+		}
+	})
+}
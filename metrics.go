@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	masterRegisteredPortKeys = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "crab_master_registered_port_keys",
+		Help: "Number of port keys registered by servers.",
+	}, func() float64 {
+		portKeyMapLock.RLock()
+		defer portKeyMapLock.RUnlock()
+		return float64(len(portKeyMap))
+	})
+	masterPendingClients = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "crab_master_pending_clients",
+		Help: "Number of clients waiting for servers of older versions to call back.",
+	}, func() float64 {
+		clientMapLock.Lock()
+		defer clientMapLock.Unlock()
+		return float64(len(clientMap))
+	})
+	masterActiveBridges = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "crab_master_active_bridges",
+		Help: "Number of client and server pairs being relayed.",
+	})
+	masterBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "crab_master_bytes_total",
+		Help: "Bytes relayed by port key id, direction is upload (client to server) or download.",
+	}, []string{"port_key", "direction"})
+	masterHandshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "crab_master_handshake_failures_total",
+		Help: "Failure responses sent to servers and clients by response code.",
+	}, []string{"code"})
+	masterMatchTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "crab_master_match_timeouts_total",
+		Help: "Clients whose server didn't connect local address in time.",
+	})
+
+	serverActiveBridges = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "crab_server_active_bridges",
+		Help: "Number of clients being relayed to local addresses.",
+	})
+	serverLocalDialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "crab_server_local_dial_failures_total",
+		Help: "Failures connecting local addresses by port mark.",
+	}, []string{"port_mark"})
+
+	clientActiveConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "crab_client_active_connections",
+		Help: "Number of local connections being relayed to servers.",
+	})
+	clientHandshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "crab_client_handshake_failures_total",
+		Help: "Failure responses received from master by response code.",
+	}, []string{"code"})
+)
+
+// serveMetrics exposes the metrics of the mode at addr in prometheus format
+func serveMetrics(addr string, mode string) {
+	switch strings.ToLower(mode) {
+	case "master":
+		prometheus.MustRegister(masterRegisteredPortKeys, masterPendingClients, masterActiveBridges,
+			masterBytes, masterHandshakeFailures, masterMatchTimeouts)
+	case "server":
+		prometheus.MustRegister(serverActiveBridges, serverLocalDialFailures)
+	case "client":
+		prometheus.MustRegister(clientActiveConnections, clientHandshakeFailures)
+	}
+
+	l := log.WithFields(log.Fields{
+		"metrics_listen": addr,
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	l.Infoln("metrics running...")
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		l.WithError(err).Fatalln("listen failed")
+	}
+}
+
+// masterResponseFailure responds a failure code to a server or client, counting it by code
+func masterResponseFailure(c net.Conn, code uint8, data []byte) error {
+	masterHandshakeFailures.WithLabelValues(strconv.Itoa(int(code))).Inc()
+	return Response(c, code, data)
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"github.com/hashicorp/yamux"
+	log "github.com/sirupsen/logrus"
+)
+
+// newMuxConfig returns the yamux config used by both ends of a multiplexed connection
+func newMuxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = log.StandardLogger().WriterLevel(log.DebugLevel)
+	return cfg
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"github.com/crabkun/crab/config"
+	"github.com/hashicorp/yamux"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// peers are other masters sharing the port key registry. every master connects to all of its peers
+// and pushes the port keys registered by its servers, a client asking for a port key which is
+// registered at a peer is forwarded to that peer through a stream of the connection the peer made.
+// a new port key is claimed from all peers before it is registered, so that two masters never
+// take it at the same time
+
+const PeerEventQueueSize = 1024
+
+// a claim not answered by every peer in time is given up
+const PeerClaimTimeout = time.Second * 3
+
+// the node id decides which of two masters claiming the same port key at once wins
+const PeerNodeIdSize = 16
+
+type peer struct {
+	Addr    string
+	Session *yamux.Session
+	Control net.Conn
+	// negotiated by the hello, outbound peers only
+	Capabilities uint32
+	// port key add and remove packets waiting to be pushed, outbound peers only
+	events chan []byte
+	// port keys registered at the peer, inbound peers only, guarded by peerPortKeyMapLock
+	PortKeys map[string]bool
+}
+
+// outbound connections, which the local port keys are pushed to
+var peerOutbound map[*peer]bool
+var peerOutboundLock sync.Mutex
+
+// port keys registered at peers, by the inbound connection of the peer
+var peerPortKeyMap map[string]*peer
+var peerPortKeyMapLock sync.RWMutex
+
+var peerTLSConfig *tls.Config
+
+var peerNodeId []byte
+
+// ips of the configured peers, resolved at start and before every connection to the peer,
+// so that accepting a peer never waits for dns
+var peerIPs = make(map[string][]net.IP)
+var peerIPsLock sync.RWMutex
+
+// claims of new port keys waiting for the answers of peers
+type portKeyClaim struct {
+	// outbound peers yet to answer
+	waiting  map[*peer]bool
+	granted  bool
+	answered chan struct{}
+	finished bool
+	// closed after the claim is given up or granted, for other servers claiming the same port key
+	done chan struct{}
+}
+
+var peerClaims = make(map[string]*portKeyClaim)
+var peerClaimsLock sync.Mutex
+
+func masterStartPeers(cfg *config.MasterConfig) error {
+	if cfg.TLS != nil {
+		var err error
+		peerTLSConfig, err = cfg.TLS.DialTLSConfig()
+		if err != nil {
+			return err
+		}
+	}
+
+	peerNodeId = make([]byte, PeerNodeIdSize)
+	_, err := rand.Read(peerNodeId)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range cfg.Peers {
+		masterResolvePeer(v)
+		go masterConnectPeer(v)
+	}
+	return nil
+}
+
+// masterResolvePeer refreshes the ips of the peer, the last ones are kept if it fails
+func masterResolvePeer(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"peer": addr,
+		}).Warnln("resolve peer failed")
+		return
+	}
+	peerIPsLock.Lock()
+	peerIPs[addr] = ips
+	peerIPsLock.Unlock()
+}
+
+// masterConnectPeer keeps the outbound connection to the peer
+func masterConnectPeer(addr string) {
+	l := log.WithFields(log.Fields{
+		"peer": addr,
+	})
+
+	b := newBackoff(ServerReconnectMinDelay, ServerReconnectMaxDelay)
+	for i := 0; ; i++ {
+		// resolved by masterStartPeers at first
+		if i != 0 {
+			masterResolvePeer(addr)
+		}
+		connected, err := masterServePeer(addr, l)
+		if connected {
+			b.Reset()
+		}
+		delay := b.Next()
+		l.WithError(err).WithFields(log.Fields{
+			"retry_in": delay.Round(time.Millisecond).String(),
+		}).Errorln("connection to peer lost")
+		time.Sleep(delay)
+	}
+}
+
+// masterServePeer pushes all local port keys to the peer and then every change of them,
+// streams opened by the peer carry the clients it forwards to us
+func masterServePeer(addr string, l *log.Entry) (bool, error) {
+	c, err := dialMaster(addr, peerTLSConfig)
+	if err != nil {
+		return false, err
+	}
+
+	// disconnect if not handshake in 3s
+	c.SetDeadline(time.Now().Add(time.Second * 3))
+
+	h, err := sayHello(c)
+	if err == errHelloRejected {
+		c.Close()
+		return false, fmt.Errorf("peer is of an older version without protocol negotiation, please upgrade peer")
+	}
+	if err != nil {
+		c.Close()
+		return false, fmt.Errorf("hello failed: %s", err)
+	}
+	if !h.Has(CapabilityPeer) {
+		c.Close()
+		return false, fmt.Errorf("peer does not support multiple masters, please upgrade peer")
+	}
+	// port key ids are shared between peers
+	if h.Salt != masterConfig.PortKeySalt {
+		c.Close()
+		return false, fmt.Errorf("peer has a different port key salt (port_key_salt)")
+	}
+
+	err = peerHandshake(c)
+	if err != nil {
+		c.Close()
+		return false, fmt.Errorf("handshake failed: %s", err)
+	}
+	c.SetDeadline(time.Time{})
+
+	session, err := yamux.Client(c, newMuxConfig())
+	if err != nil {
+		c.Close()
+		return false, err
+	}
+	defer session.Close()
+
+	control, err := session.Open()
+	if err != nil {
+		return false, err
+	}
+
+	p := &peer{
+		Addr:         addr,
+		Session:      session,
+		Control:      control,
+		Capabilities: h.Capabilities,
+		events:       make(chan []byte, PeerEventQueueSize),
+	}
+
+	// the port keys registered after the snapshot are queued as events
+	portKeyMapLock.RLock()
+	snapshot := make([]string, 0, len(portKeyMap))
+	for k := range portKeyMap {
+		snapshot = append(snapshot, k)
+	}
+	peerOutboundLock.Lock()
+	peerOutbound[p] = true
+	peerOutboundLock.Unlock()
+	portKeyMapLock.RUnlock()
+
+	defer func() {
+		peerOutboundLock.Lock()
+		delete(peerOutbound, p)
+		peerOutboundLock.Unlock()
+		masterDropClaims(p)
+	}()
+
+	l.Infoln("peer connected")
+
+	go func() {
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+
+			go masterHandleClientStream(stream, true)
+		}
+	}()
+
+	// the peer only answers claims
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			packet, err := ReadFromSocket(control)
+			if err != nil {
+				return
+			}
+			switch packet[0] {
+			case ResponseCodePortKeyClaimGranted, ResponseCodePortKeyClaimDenied:
+				masterClaimAnswered(p, string(packet[1:]), packet[0] == ResponseCodePortKeyClaimGranted)
+			}
+		}
+	}()
+
+	for _, v := range snapshot {
+		err = SendCommand(control, CommandPeerPortKeyAdd, []byte(v))
+		if err != nil {
+			return true, err
+		}
+	}
+
+	for {
+		select {
+		case packet := <-p.events:
+			err = WriteToSocket(control, packet, p.Capabilities)
+			if err != nil {
+				return true, err
+			}
+		case <-closed:
+			return true, io.EOF
+		}
+	}
+}
+
+func peerHandshake(c net.Conn) error {
+	peerNonce, err := newAuthNonce()
+	if err != nil {
+		return err
+	}
+	err = SendCommand(c, CommandPeerHandshake, peerNonce)
+	if err != nil {
+		return err
+	}
+
+	var masterNonce []byte
+	masterProved := false
+	for {
+		buf, err := ReadHandshakeFromSocket(c)
+		if err != nil {
+			return err
+		}
+		code := buf[0]
+		buf = buf[1:]
+
+		switch code {
+		case ResponseCodeAuthChallenge:
+			if len(buf) != AuthNonceSize || masterNonce != nil {
+				return fmt.Errorf("invalid auth challenge")
+			}
+			masterNonce = buf
+			err = SendCommand(c, CommandServerAuthResponse, authProof(masterConfig.PeerKey, masterConfig.PortKeySalt, "peer", masterNonce, peerNonce))
+			if err != nil {
+				return err
+			}
+		case ResponseCodeAuthProof:
+			if masterNonce == nil || !hmac.Equal(buf, authProof(masterConfig.PeerKey, masterConfig.PortKeySalt, "master", peerNonce, masterNonce)) {
+				return fmt.Errorf("peer failed to prove that it knows the peer key")
+			}
+			masterProved = true
+		case ResponseCodeReady:
+			if !masterProved {
+				return fmt.Errorf("peer did not prove that it knows the peer key")
+			}
+			return nil
+		case ResponseCodeMasterKeyMismatch:
+			return fmt.Errorf("peer reported that peer key mismatch or this master is not one of its peers")
+		default:
+			return fmt.Errorf("peer response an unsupported code %d", code)
+		}
+	}
+}
+
+// masterNotifyPeers queues the change of a local port key to all peers,
+// portKeyMapLock must be held so that the changes are pushed in order
+func masterNotifyPeers(command uint8, portKey string) {
+	peerOutboundLock.Lock()
+	defer peerOutboundLock.Unlock()
+
+	for p := range peerOutbound {
+		select {
+		case p.events <- append([]byte{command}, portKey...):
+		default:
+			// the peer is too slow, reconnecting pushes all port keys again
+			p.Session.Close()
+		}
+	}
+}
+
+// masterClaimPortKey asks all connected peers whether a new port key may be registered here,
+// any peer which has it or is claiming it too with a smaller node id refuses it.
+// peers which are not connected can't refuse, a port key registered at both sides is warned
+// about when they connect again
+func masterClaimPortKey(portKey string) bool {
+	peerClaimsLock.Lock()
+	if c, exist := peerClaims[portKey]; exist {
+		// another server is claiming it here
+		peerClaimsLock.Unlock()
+		<-c.done
+		return c.granted
+	}
+
+	c := &portKeyClaim{
+		waiting:  make(map[*peer]bool),
+		granted:  true,
+		answered: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	packet := append(append([]byte{CommandPeerPortKeyClaim}, peerNodeId...), portKey...)
+	peerOutboundLock.Lock()
+	for p := range peerOutbound {
+		select {
+		case p.events <- packet:
+			c.waiting[p] = true
+		default:
+			p.Session.Close()
+		}
+	}
+	peerOutboundLock.Unlock()
+	if len(c.waiting) == 0 {
+		peerClaimsLock.Unlock()
+		return true
+	}
+	peerClaims[portKey] = c
+	peerClaimsLock.Unlock()
+
+	select {
+	case <-c.answered:
+	case <-time.After(PeerClaimTimeout):
+	}
+
+	peerClaimsLock.Lock()
+	delete(peerClaims, portKey)
+	if len(c.waiting) != 0 {
+		log.WithFields(log.Fields{
+			"port_key": portKey,
+		}).Warnln("claim port key timeout, some peers did not answer")
+		c.granted = false
+	}
+	peerClaimsLock.Unlock()
+	close(c.done)
+
+	if !c.granted {
+		masterReleasePortKey(portKey)
+	}
+	return c.granted
+}
+
+// masterReleasePortKey gives back a port key claimed but not registered to the peers which granted it
+func masterReleasePortKey(portKey string) {
+	portKeyMapLock.RLock()
+	defer portKeyMapLock.RUnlock()
+	if _, local := portKeyMap[portKey]; !local {
+		masterNotifyPeers(CommandPeerPortKeyRemove, portKey)
+	}
+}
+
+// masterClaimAnswered records the answer of an outbound peer to the claim of the port key
+func masterClaimAnswered(p *peer, portKey string, granted bool) {
+	peerClaimsLock.Lock()
+	defer peerClaimsLock.Unlock()
+
+	c, exist := peerClaims[portKey]
+	if !exist || !c.waiting[p] {
+		return
+	}
+	delete(c.waiting, p)
+	if !granted {
+		c.granted = false
+	}
+	if !c.granted || len(c.waiting) == 0 {
+		c.finish()
+	}
+}
+
+// masterDropClaims stops waiting for a disconnected outbound peer
+func masterDropClaims(p *peer) {
+	peerClaimsLock.Lock()
+	defer peerClaimsLock.Unlock()
+
+	for _, c := range peerClaims {
+		if !c.waiting[p] {
+			continue
+		}
+		delete(c.waiting, p)
+		if len(c.waiting) == 0 {
+			c.finish()
+		}
+	}
+}
+
+// finish wakes the claimer, peerClaimsLock must be held
+func (c *portKeyClaim) finish() {
+	if !c.finished {
+		c.finished = true
+		close(c.answered)
+	}
+}
+
+// masterGrantPortKey answers the claim of an inbound peer, a granted port key is taken as
+// registered at the peer until it is removed or the peer disconnects
+func masterGrantPortKey(p *peer, nodeId []byte, portKey string) bool {
+	portKeyMapLock.RLock()
+	defer portKeyMapLock.RUnlock()
+
+	if _, local := portKeyMap[portKey]; local {
+		return false
+	}
+
+	peerClaimsLock.Lock()
+	_, claiming := peerClaims[portKey]
+	peerClaimsLock.Unlock()
+	if claiming && bytes.Compare(peerNodeId, nodeId) < 0 {
+		return false
+	}
+
+	peerPortKeyMapLock.Lock()
+	defer peerPortKeyMapLock.Unlock()
+	if owner, exist := peerPortKeyMap[portKey]; exist && owner != p {
+		return false
+	}
+	peerPortKeyMap[portKey] = p
+	p.PortKeys[portKey] = true
+	return true
+}
+
+// masterIsPeer tells whether the connection comes from one of the configured peers,
+// by the ips which their addresses were resolved to
+func masterIsPeer(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	peerIPsLock.RLock()
+	defer peerIPsLock.RUnlock()
+	for _, ips := range peerIPs {
+		for _, ip := range ips {
+			if ip.Equal(tcpAddr.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// masterHandlePeer receives the port keys registered at the peer, only configured peers
+// knowing the peer key are accepted
+func masterHandlePeer(conn net.Conn, peerNonce []byte) {
+	l := log.WithFields(log.Fields{
+		"remote_addr": conn.RemoteAddr(),
+		"remote_type": "peer",
+	})
+
+	if !masterAuthChallenge(conn, l, masterConfig.PeerKey, "peer", peerNonce) {
+		conn.Close()
+		return
+	}
+
+	// the address is trusted only after the peer proved that it knows the peer key
+	if !masterIsPeer(conn.RemoteAddr()) {
+		l.Warnln("connection is not from a configured peer")
+		masterResponseFailure(conn, ResponseCodeMasterKeyMismatch, nil)
+		conn.Close()
+		return
+	}
+
+	// cancel handshake deadline
+	conn.SetDeadline(time.Time{})
+
+	if Response(conn, ResponseCodeReady, nil) != nil {
+		conn.Close()
+		return
+	}
+
+	session, err := yamux.Server(conn, newMuxConfig())
+	if err != nil {
+		l.WithError(err).Errorln("init mux session failed")
+		conn.Close()
+		return
+	}
+	defer session.Close()
+
+	control, err := session.Accept()
+	if err != nil {
+		l.WithError(err).Debugln("accept control stream failed")
+		return
+	}
+
+	p := &peer{
+		Addr:     conn.RemoteAddr().String(),
+		Session:  session,
+		Control:  control,
+		PortKeys: make(map[string]bool),
+	}
+
+	defer func() {
+		peerPortKeyMapLock.Lock()
+		for k := range p.PortKeys {
+			if peerPortKeyMap[k] == p {
+				delete(peerPortKeyMap, k)
+			}
+		}
+		peerPortKeyMapLock.Unlock()
+	}()
+
+	l.Debugln("peer connected")
+
+	for {
+		packet, err := ReadFromSocket(control)
+		if err != nil {
+			l.WithError(err).Debugln("peer disconnected")
+			return
+		}
+		command := packet[0]
+		portKey := string(packet[1:])
+
+		switch command {
+		case CommandPeerPortKeyClaim:
+			if len(packet) < 1+PeerNodeIdSize {
+				return
+			}
+			portKey = string(packet[1+PeerNodeIdSize:])
+			code := uint8(ResponseCodePortKeyClaimDenied)
+			if masterGrantPortKey(p, packet[1:1+PeerNodeIdSize], portKey) {
+				code = ResponseCodePortKeyClaimGranted
+			}
+			err = Response(control, code, []byte(portKey))
+			if err != nil {
+				return
+			}
+		case CommandPeerPortKeyAdd:
+			// a port key served here is never handed over to a peer
+			portKeyMapLock.RLock()
+			_, local := portKeyMap[portKey]
+			if !local {
+				peerPortKeyMapLock.Lock()
+				peerPortKeyMap[portKey] = p
+				p.PortKeys[portKey] = true
+				peerPortKeyMapLock.Unlock()
+			}
+			portKeyMapLock.RUnlock()
+			if local {
+				l.WithFields(log.Fields{
+					"port_key": portKey,
+				}).Warnln("peer pushed a port key registered here, ignored")
+			}
+		case CommandPeerPortKeyRemove:
+			peerPortKeyMapLock.Lock()
+			if peerPortKeyMap[portKey] == p {
+				delete(peerPortKeyMap, portKey)
+			}
+			delete(p.PortKeys, portKey)
+			peerPortKeyMapLock.Unlock()
+		default:
+			// unsupported command
+			return
+		}
+	}
+}
+
+func masterPeerHasPortKey(portKey string) bool {
+	peerPortKeyMapLock.RLock()
+	defer peerPortKeyMapLock.RUnlock()
+	_, exist := peerPortKeyMap[portKey]
+	return exist
+}
+
+// masterForwardToPeer hands the client over to the peer which has the port key,
+// the peer answers the client directly and everything is relayed as it is
+func masterForwardToPeer(conn net.Conn, portKey string) bool {
+	peerPortKeyMapLock.RLock()
+	p, exist := peerPortKeyMap[portKey]
+	peerPortKeyMapLock.RUnlock()
+	if !exist {
+		return false
+	}
+
+	l := log.WithFields(log.Fields{
+		"remote_addr": conn.RemoteAddr(),
+		"remote_type": "client",
+		"peer":        p.Addr,
+		"port_key":    portKey,
+	})
+
+	stream, err := p.Session.Open()
+	if err != nil {
+		l.WithError(err).Debugln("open stream to peer failed")
+		return false
+	}
+	err = SendCommand(stream, CommandClientHandshake, []byte(portKey))
+	if err != nil {
+		l.WithError(err).Debugln("forward client to peer failed")
+		stream.Close()
+		return false
+	}
+
+	l.Debugln("client forwarded to peer")
+	relayPair(conn, stream, stream, conn, nil, nil, func(up, down RelayResult) {
+		l.WithFields(log.Fields{
+			"upload":       up.Bytes,
+			"download":     down.Bytes,
+			"upload_end":   up.Cause(),
+			"download_end": down.Cause(),
+		}).Debugln("forwarded client closed")
+	})
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func lockPeerMaps(f func()) {
+	portKeyMapLock.Lock()
+	peerClaimsLock.Lock()
+	peerPortKeyMapLock.Lock()
+	f()
+	peerPortKeyMapLock.Unlock()
+	peerClaimsLock.Unlock()
+	portKeyMapLock.Unlock()
+}
+
+func TestMasterGrantPortKey(t *testing.T) {
+	startTestMaster(t)
+	defer func(id []byte) { peerNodeId = id }(peerNodeId)
+	peerNodeId = bytes.Repeat([]byte{5}, PeerNodeIdSize)
+	smaller := bytes.Repeat([]byte{1}, PeerNodeIdSize)
+	larger := bytes.Repeat([]byte{9}, PeerNodeIdSize)
+
+	claimer := &peer{PortKeys: make(map[string]bool)}
+	other := &peer{PortKeys: make(map[string]bool)}
+
+	tests := []struct {
+		name    string
+		setup   func(portKey string)
+		nodeId  []byte
+		granted bool
+	}{
+		{"free", func(string) {}, smaller, true},
+		{"registered here", func(portKey string) {
+			portKeyMap[portKey] = &portKeyServers{}
+		}, smaller, false},
+		{"registered at another peer", func(portKey string) {
+			peerPortKeyMap[portKey] = other
+		}, smaller, false},
+		{"granted to the same peer before", func(portKey string) {
+			peerPortKeyMap[portKey] = claimer
+		}, smaller, true},
+		{"claimed here by a larger node id", func(portKey string) {
+			peerClaims[portKey] = &portKeyClaim{}
+		}, smaller, true},
+		{"claimed here by a smaller node id", func(portKey string) {
+			peerClaims[portKey] = &portKeyClaim{}
+		}, larger, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			portKey := "grant test " + tt.name
+			lockPeerMaps(func() { tt.setup(portKey) })
+			defer lockPeerMaps(func() {
+				delete(portKeyMap, portKey)
+				delete(peerPortKeyMap, portKey)
+				delete(peerClaims, portKey)
+			})
+
+			granted := masterGrantPortKey(claimer, tt.nodeId, portKey)
+			if granted != tt.granted {
+				t.Fatalf("granted %v", granted)
+			}
+			if granted && !masterPeerHasPortKey(portKey) {
+				t.Fatal("granted port key not taken as registered at the peer")
+			}
+		})
+	}
+}
+
+func TestMasterIsPeer(t *testing.T) {
+	peerIPsLock.Lock()
+	peerIPs["peer.test:51324"] = []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("::2")}
+	peerIPsLock.Unlock()
+	defer func() {
+		peerIPsLock.Lock()
+		delete(peerIPs, "peer.test:51324")
+		peerIPsLock.Unlock()
+	}()
+
+	tests := []struct {
+		addr net.Addr
+		peer bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::2"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 1234}, false},
+		{&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}, false},
+	}
+	for _, tt := range tests {
+		if got := masterIsPeer(tt.addr); got != tt.peer {
+			t.Errorf("masterIsPeer(%s) = %v", tt.addr, got)
+		}
+	}
+}
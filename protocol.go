@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"time"
+)
+
+// every connection to master starts with a hello in both directions, which tells the protocol version
+// and the capabilities of each side, a feature is only used if both sides have its capability.
+// sides of older versions start with the handshake directly, they have no capability at all:
+// the master key and the port key are sent in plain text and every client is called back
+
+const ProtocolVersion = 1
+
+const (
+	CapabilityMux = 1 << iota
+	CapabilityAuth
+	CapabilityHeartbeat
+	CapabilityUnregister
+	CapabilityLongPacket
+	CapabilityPeer
+)
+
+const LocalCapabilities = CapabilityMux | CapabilityAuth | CapabilityHeartbeat |
+	CapabilityUnregister | CapabilityLongPacket | CapabilityPeer
+
+// errHelloRejected tells that master is of an older version, which closes the connection on unknown commands
+var errHelloRejected = errors.New("master closed the connection on hello")
+
+// tags of the hello fields, unknown tags are skipped so that fields can be added freely
+const (
+	HelloTagVersion      = 1
+	HelloTagCapabilities = 2
+	HelloTagSalt         = 3
+)
+
+type hello struct {
+	Version      uint16
+	Capabilities uint32
+	// the salt of port key ids, only masters have it
+	Salt string
+}
+
+// localSalt is the salt of port key ids when running as master
+var localSalt string
+
+func localHello() *hello {
+	return &hello{
+		Version:      ProtocolVersion,
+		Capabilities: LocalCapabilities,
+		Salt:         localSalt,
+	}
+}
+
+// legacyHello stands for the hello of a side of an older version, which says none
+func legacyHello() *hello {
+	return &hello{}
+}
+
+func (h *hello) Has(capability uint32) bool {
+	return h.Capabilities&capability != 0
+}
+
+// Marshal encodes the fields as tlv, a tag byte and a 2 bytes length before every value
+func (h *hello) Marshal() []byte {
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, h.Version)
+	capabilities := make([]byte, 4)
+	binary.BigEndian.PutUint32(capabilities, h.Capabilities)
+
+	buf := make([]byte, 0, 16+len(h.Salt))
+	buf = appendTLV(buf, HelloTagVersion, version)
+	buf = appendTLV(buf, HelloTagCapabilities, capabilities)
+	if h.Salt != "" {
+		buf = appendTLV(buf, HelloTagSalt, []byte(h.Salt))
+	}
+	return buf
+}
+
+func parseHello(buf []byte) (*hello, error) {
+	h := &hello{}
+	for len(buf) != 0 {
+		if len(buf) < 3 {
+			return nil, fmt.Errorf("invalid hello field")
+		}
+		tag := buf[0]
+		length := int(binary.BigEndian.Uint16(buf[1:3]))
+		buf = buf[3:]
+		if len(buf) < length {
+			return nil, fmt.Errorf("invalid hello field length %d", length)
+		}
+		value := buf[:length]
+		buf = buf[length:]
+
+		switch tag {
+		case HelloTagVersion:
+			if length != 2 {
+				return nil, fmt.Errorf("invalid hello version")
+			}
+			h.Version = binary.BigEndian.Uint16(value)
+		case HelloTagCapabilities:
+			if length != 4 {
+				return nil, fmt.Errorf("invalid hello capabilities")
+			}
+			h.Capabilities = binary.BigEndian.Uint32(value)
+		case HelloTagSalt:
+			h.Salt = string(value)
+		}
+	}
+	return h, nil
+}
+
+func appendTLV(buf []byte, tag uint8, value []byte) []byte {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(value)))
+	buf = append(buf, tag)
+	buf = append(buf, length...)
+	return append(buf, value...)
+}
+
+// sayHello negotiates with master before the handshake,
+// the capabilities supported by both sides are returned
+func sayHello(c net.Conn) (*hello, error) {
+	err := SendCommand(c, CommandHello, localHello().Marshal())
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := ReadHandshakeFromSocket(c)
+	if err == io.EOF {
+		return nil, errHelloRejected
+	}
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != ResponseCodeHello {
+		return nil, fmt.Errorf("master response an unsupported code %d", buf[0])
+	}
+
+	h, err := parseHello(buf[1:])
+	if err != nil {
+		return nil, err
+	}
+	h.Capabilities &= LocalCapabilities
+	return h, nil
+}
+
+// dialMasterHello dials master and says hello, the connection is left with the handshake deadline.
+// a master of an older version rejecting the hello is dialed again without it if allowLegacy is set,
+// the hello returned for it has no capability
+func dialMasterHello(addr string, tlsConfig *tls.Config, allowLegacy bool) (net.Conn, *hello, error) {
+	c, err := dialMaster(addr, tlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// disconnect if not handshake in 3s
+	c.SetDeadline(time.Now().Add(time.Second * 3))
+
+	h, err := sayHello(c)
+	if err == nil {
+		return c, h, nil
+	}
+	c.Close()
+	if err != errHelloRejected {
+		return nil, nil, fmt.Errorf("hello failed: %s", err)
+	}
+	if !allowLegacy {
+		return nil, nil, fmt.Errorf("master is of an older version without protocol negotiation, " +
+			"please upgrade master or set allow_legacy_master")
+	}
+
+	log.WithFields(log.Fields{
+		"master": addr,
+	}).Warnln("master is of an older version without protocol negotiation, keys are sent in plain text, please upgrade master")
+
+	c, err = dialMaster(addr, tlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.SetDeadline(time.Now().Add(time.Second * 3))
+	return c, legacyHello(), nil
+}
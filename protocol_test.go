@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHello(t *testing.T) {
+	full := &hello{Version: ProtocolVersion, Capabilities: LocalCapabilities, Salt: "salt"}
+
+	tests := []struct {
+		name  string
+		input []byte
+		hello *hello
+		fail  bool
+	}{
+		{"marshaled", full.Marshal(), full, false},
+		{"without salt", (&hello{Version: 2, Capabilities: CapabilityMux}).Marshal(),
+			&hello{Version: 2, Capabilities: CapabilityMux}, false},
+		{"empty", []byte{}, &hello{}, false},
+		{"unknown tag skipped", append([]byte{0x7F, 0, 3, 'a', 'b', 'c'}, full.Marshal()...), full, false},
+		{"empty unknown tag", []byte{0x7F, 0, 0}, &hello{}, false},
+		{"later field wins", append(full.Marshal(), HelloTagVersion, 0, 2, 0, 9),
+			&hello{Version: 9, Capabilities: LocalCapabilities, Salt: "salt"}, false},
+		{"truncated header", []byte{HelloTagVersion, 0}, nil, true},
+		{"truncated value", []byte{HelloTagSalt, 0, 5, 'a'}, nil, true},
+		{"short version", []byte{HelloTagVersion, 0, 1, 1}, nil, true},
+		{"long capabilities", []byte{HelloTagCapabilities, 0, 5, 0, 0, 0, 0, 1}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := parseHello(tt.input)
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("parsed %+v", h)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(h, tt.hello) {
+				t.Fatalf("parsed %+v instead of %+v", h, tt.hello)
+			}
+		})
+	}
+}
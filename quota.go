@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/crabkun/crab/config"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+// trafficCounter counts bytes of both directions, the day and month counters
+// are reset when a new day or month begins
+type trafficCounter struct {
+	// added by every relayed write without a lock, keep them first for atomic alignment
+	dayBytes   int64
+	monthBytes int64
+	totalBytes int64
+
+	// nil if unlimited
+	quota *config.QuotaConfig
+
+	// guards day and month
+	lock  sync.Mutex
+	day   string
+	month string
+}
+
+// trafficCounterState is how a counter is saved in the quota state file
+type trafficCounterState struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+	TotalBytes int64  `json:"total_bytes"`
+}
+
+func (c *trafficCounter) roll(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	day := now.Format("2006-01-02")
+	if c.day != day {
+		c.day = day
+		atomic.StoreInt64(&c.dayBytes, 0)
+	}
+	month := now.Format("2006-01")
+	if c.month != month {
+		c.month = month
+		atomic.StoreInt64(&c.monthBytes, 0)
+	}
+}
+
+// add counts n bytes and reports whether the quota is used up
+func (c *trafficCounter) add(n int64) bool {
+	day := atomic.AddInt64(&c.dayBytes, n)
+	month := atomic.AddInt64(&c.monthBytes, n)
+	atomic.AddInt64(&c.totalBytes, n)
+	return c.reached(day, month)
+}
+
+func (c *trafficCounter) exceeded() bool {
+	c.roll(time.Now())
+	return c.reached(atomic.LoadInt64(&c.dayBytes), atomic.LoadInt64(&c.monthBytes))
+}
+
+func (c *trafficCounter) reached(day int64, month int64) bool {
+	return c.quota != nil && ((c.quota.Daily > 0 && day >= c.quota.Daily) ||
+		(c.quota.Monthly > 0 && month >= c.quota.Monthly))
+}
+
+func (c *trafficCounter) state() *trafficCounterState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return &trafficCounterState{
+		Day:        c.day,
+		DayBytes:   atomic.LoadInt64(&c.dayBytes),
+		Month:      c.month,
+		MonthBytes: atomic.LoadInt64(&c.monthBytes),
+		TotalBytes: atomic.LoadInt64(&c.totalBytes),
+	}
+}
+
+// counters of port keys are keyed by "port_key/<id>", of servers by "server/<name>"
+var trafficCounterMap = make(map[string]*trafficCounter)
+var trafficCounterMapLock sync.Mutex
+
+// set by every relayed write while a state file is kept
+var trafficCounterDirty int32
+
+func trafficCounterKeys(portKey string, serverName string) []string {
+	keys := []string{"port_key/" + portKey}
+	if serverName != "" {
+		keys = append(keys, "server/"+serverName)
+	}
+	return keys
+}
+
+func trafficQuota(key string) *config.QuotaConfig {
+	if strings.HasPrefix(key, "server/") {
+		return masterConfig.GetServerQuota(strings.TrimPrefix(key, "server/"))
+	}
+	return masterConfig.GetPortKeyQuota(strings.TrimPrefix(key, "port_key/"))
+}
+
+// getTrafficCounter returns nil if the traffic needs no counting, which is when it has no quota
+// and there is no state file to keep the totals in, trafficCounterMapLock must be held
+func getTrafficCounter(key string) *trafficCounter {
+	c, exist := trafficCounterMap[key]
+	if !exist {
+		quota := trafficQuota(key)
+		if quota == nil && masterConfig.QuotaStateFile == "" {
+			return nil
+		}
+		c = &trafficCounter{
+			quota: quota,
+		}
+		trafficCounterMap[key] = c
+	}
+	return c
+}
+
+// masterGetTrafficCounters returns the counters of the port key and the server holding it
+func masterGetTrafficCounters(portKey string, serverName string) []*trafficCounter {
+	trafficCounterMapLock.Lock()
+	defer trafficCounterMapLock.Unlock()
+
+	var counters []*trafficCounter
+	for _, v := range trafficCounterKeys(portKey, serverName) {
+		if c := getTrafficCounter(v); c != nil {
+			counters = append(counters, c)
+		}
+	}
+	return counters
+}
+
+// masterQuotaExceeded reports whether the port key or the server holding it used up its quota
+func masterQuotaExceeded(portKey string, serverName string) bool {
+	for _, c := range masterGetTrafficCounters(portKey, serverName) {
+		if c.exceeded() {
+			return true
+		}
+	}
+	return false
+}
+
+// masterTrafficCounter counts the relayed bytes into the traffic counters,
+// and fails after the quota is used up so that the bridge is cut.
+// the counters are looked up once, every write only adds to them
+func masterTrafficCounter(portKey string, serverName string, direction string, bytes *int64) relayCounter {
+	counters := masterGetTrafficCounters(portKey, serverName)
+	for _, c := range counters {
+		c.roll(time.Now())
+	}
+	relayed := masterBytes.WithLabelValues(portKey, direction)
+
+	return func(n int) error {
+		atomic.AddInt64(bytes, int64(n))
+		relayed.Add(float64(n))
+		if len(counters) == 0 {
+			return nil
+		}
+		if masterConfig.QuotaStateFile != "" && atomic.LoadInt32(&trafficCounterDirty) == 0 {
+			atomic.StoreInt32(&trafficCounterDirty, 1)
+		}
+		exceeded := false
+		for _, c := range counters {
+			if c.add(int64(n)) {
+				exceeded = true
+			}
+		}
+		if exceeded {
+			return errQuotaExceeded
+		}
+		return nil
+	}
+}
+
+// masterRollTrafficCounters resets the day and month counters when a new day or month begins,
+// so that bridges lasting for days are counted into the new day
+func masterRollTrafficCounters() {
+	for now := range time.Tick(time.Minute) {
+		trafficCounterMapLock.Lock()
+		for _, c := range trafficCounterMap {
+			c.roll(now)
+		}
+		trafficCounterMapLock.Unlock()
+	}
+}
+
+func masterLoadTrafficCounters(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var states map[string]*trafficCounterState
+	err = json.Unmarshal(buf, &states)
+	if err != nil {
+		return err
+	}
+
+	trafficCounterMapLock.Lock()
+	defer trafficCounterMapLock.Unlock()
+	for k, v := range states {
+		trafficCounterMap[k] = &trafficCounter{
+			dayBytes:   v.DayBytes,
+			monthBytes: v.MonthBytes,
+			totalBytes: v.TotalBytes,
+			quota:      trafficQuota(k),
+			day:        v.Day,
+			month:      v.Month,
+		}
+	}
+	return nil
+}
+
+func masterSaveTrafficCounters(path string) error {
+	if atomic.SwapInt32(&trafficCounterDirty, 0) == 0 {
+		return nil
+	}
+
+	trafficCounterMapLock.Lock()
+	states := make(map[string]*trafficCounterState, len(trafficCounterMap))
+	for k, v := range trafficCounterMap {
+		states[k] = v.state()
+	}
+	trafficCounterMapLock.Unlock()
+
+	buf, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file first so that a crash never leaves a broken state file
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func masterPersistTrafficCounters(path string) {
+	l := log.WithFields(log.Fields{
+		"quota_state_file": path,
+	})
+
+	for range time.Tick(time.Second * 10) {
+		err := masterSaveTrafficCounters(path)
+		if err != nil {
+			l.WithError(err).Errorln("save traffic counters failed")
+		}
+	}
+}
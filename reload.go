@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// loadConfig reads the config file again into cfg, the caller validates it
+func loadConfig(cfg interface{}) error {
+	buf, err := ioutil.ReadFile(ConfigFile)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, cfg)
+}
+
+// watchReload calls reload every time SIGHUP is received
+func watchReload(reload func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			log.WithFields(log.Fields{
+				"file": ConfigFile,
+			}).Infoln("SIGHUP received, reloading configure file")
+			reload()
+		}
+	}()
+}
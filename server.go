@@ -1,101 +1,227 @@
 package main
 
 import (
-	"github.com/crabkun/crab/compress"
+	"crypto/hmac"
+	"crypto/tls"
+	"fmt"
 	"github.com/crabkun/crab/config"
-	"github.com/crabkun/crab/crypto"
+	"github.com/hashicorp/yamux"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var serverConfig *config.ServerConfig
+var serverTLSConfig *tls.Config
+
+// serverConfig.Ports may be replaced by reloading
+var serverPortsLock sync.RWMutex
+
+// capabilities of the current master and us
+var serverMasterCapabilities uint32
+
+// the salt of port key ids of the current master, empty for masters of older versions
+var serverMasterSalt atomic.Value
+
+// backends of the ports by port key, guarded by serverPortsLock
+var serverPools map[string]*backendPool
+
+// the control stream of the current master connection, nil while disconnected
+var serverControl net.Conn
+var serverControlLock sync.Mutex
 
 func ServerMain(cfg *config.ServerConfig) {
 	var err error
 	serverConfig = cfg
 
-	l := log.WithFields(log.Fields{
-		"master": cfg.Master,
-	})
+	if cfg.TLS != nil {
+		serverTLSConfig, err = cfg.TLS.DialTLSConfig()
+		if err != nil {
+			log.WithError(err).Fatalln("load tls config failed")
+		}
+	}
+
+	serverPools = serverBuildPools(cfg.Ports, nil)
+
+	watchReload(serverReload)
+
+	// servers reconnecting to a restarted master spread out by the jitter of backoff,
+	// every failure switches to the next master address
+	b := newBackoff(ServerReconnectMinDelay, ServerReconnectMaxDelay)
+	disconnectedAt := time.Now()
+	i := 0
+	for {
+		addr := cfg.Master[i]
+		l := log.WithFields(log.Fields{
+			"master": addr,
+		})
+
+		session, control, err := serverConnectMaster(addr)
+		if err != nil {
+			delay := b.Next()
+			l.WithError(err).WithFields(log.Fields{
+				"disconnected_for": time.Since(disconnectedAt).Round(time.Second).String(),
+				"retry_in":         delay.Round(time.Millisecond).String(),
+			}).Errorln("connect master failed")
+			time.Sleep(delay)
+			i = (i + 1) % len(cfg.Master)
+			continue
+		}
+		connectedAt := time.Now()
+		l.WithFields(log.Fields{
+			"disconnected_for": connectedAt.Sub(disconnectedAt).Round(time.Second).String(),
+		}).Infoln("master connected")
+
+		serverServeControl(l, addr, session, control)
+		disconnectedAt = time.Now()
+
+		// only a session which stayed up resets the backoff, so that a master accepting and
+		// dropping at once is not redialed in a hot loop by all servers at the same time
+		if disconnectedAt.Sub(connectedAt) >= ServerReconnectResetAfter {
+			b.Reset()
+		}
+		delay := b.Next()
+		l.WithFields(log.Fields{
+			"retry_in": delay.Round(time.Millisecond).String(),
+		}).Infoln("reconnecting master")
+		time.Sleep(delay)
+	}
+}
+
+// serverConnectMaster handshakes with master, then opens the control stream of the mux session.
+// a master of an older version has no session, the connection itself is the control one
+func serverConnectMaster(addr string) (*yamux.Session, net.Conn, error) {
+	c, h, err := dialMasterHello(addr, serverTLSConfig, serverConfig.AllowLegacyMaster)
+	if err != nil {
+		return nil, nil, err
+	}
+	atomic.StoreUint32(&serverMasterCapabilities, h.Capabilities)
+	serverMasterSalt.Store(h.Salt)
 
-ConnectMaster:
-	c, err := net.Dial("tcp", cfg.Master)
+	if h.Version == 0 {
+		err = serverLegacyHandshake(c, addr)
+		if err != nil {
+			c.Close()
+			return nil, nil, fmt.Errorf("handshake failed: %s", err)
+		}
+		c.SetDeadline(time.Time{})
+		return nil, c, nil
+	}
+	// the master key is never sent in plain text, and callback connections are gone
+	if !h.Has(CapabilityAuth) || !h.Has(CapabilityMux) {
+		c.Close()
+		return nil, nil, fmt.Errorf("master does not support challenge handshake or multiplexing, please upgrade master")
+	}
+	if h.Salt == "" {
+		c.Close()
+		return nil, nil, fmt.Errorf("master sent no port key salt")
+	}
+
+	err = serverHandshake(c, addr)
 	if err != nil {
-		l.WithError(err).Errorln("dial master failed, reconnecting in 3s")
-		time.Sleep(time.Second * 3)
-		goto ConnectMaster
+		c.Close()
+		return nil, nil, fmt.Errorf("handshake failed: %s", err)
 	}
+	c.SetDeadline(time.Time{})
 
-	// disconnect if not handshake in 3s
-	c.SetDeadline(time.Now().Add(time.Second * 3))
+	// from now on every client is carried by a stream opened by master
+	session, err := yamux.Client(c, newMuxConfig())
+	if err != nil {
+		c.Close()
+		return nil, nil, fmt.Errorf("init mux session failed: %s", err)
+	}
+	control, err := session.Open()
+	if err != nil {
+		session.Close()
+		return nil, nil, fmt.Errorf("open control stream failed: %s", err)
+	}
+	return session, control, nil
+}
+
+// serverServeControl registers the port keys and handles the responses of master,
+// it returns after the connection is lost
+func serverServeControl(l *log.Entry, addr string, session *yamux.Session, control net.Conn) {
+	if session != nil {
+		go serverAcceptStreams(session)
+	}
+
+	// handshake success, starting to register port key
+	serverControlLock.Lock()
+	serverControl = control
+	serverPortsLock.RLock()
+	for _, v := range serverConfig.Ports {
+		SendCommand(control, CommandServerRegisterPortKey, serverWireKey(v))
+	}
+	serverPortsLock.RUnlock()
+	serverControlLock.Unlock()
+
+	// masters without heartbeat close the connection on ping
+	heartbeat := serverMasterHas(CapabilityHeartbeat)
+	heartbeatDone := make(chan struct{})
+	if heartbeat {
+		go serverHeartbeat(control, heartbeatDone)
+	}
 
-	SendCommand(c, CommandServerHandshake, []byte(cfg.MasterKey))
 	for {
-		buf, err := ReadFromSocket(c)
+		if heartbeat {
+			control.SetReadDeadline(time.Now().Add(time.Second * time.Duration(serverConfig.HeartbeatTimeout)))
+		}
+		buf, err := ReadFromSocket(control)
 		if err != nil {
-			l.WithError(err).Errorln("read from master failed, reconnecting in 3s")
-			c.Close()
-			time.Sleep(time.Second * 3)
-			goto ConnectMaster
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				l.Errorln("master heartbeat timeout, reconnecting")
+			} else {
+				l.WithError(err).Errorln("read from master failed, reconnecting")
+			}
+			close(heartbeatDone)
+			serverControlLock.Lock()
+			serverControl = nil
+			serverControlLock.Unlock()
+			if session != nil {
+				session.Close()
+			} else {
+				control.Close()
+			}
+			return
 		}
 		code := buf[0]
 		buf = buf[1:]
 
 		switch code {
-		case ResponseCodeReady:
-			c.SetDeadline(time.Time{})
-			// handshake success, starting to register port key
-			for _, v := range serverConfig.Ports {
-				SendCommand(c, CommandServerRegisterPortKey, []byte(v.PortKey))
-			}
-		case ResponseCodeMasterKeyMismatch:
-			l.Fatalln("master reported that master key mismatch")
-		case ResponseCodePortKeyExist, ResponseCodePortKeyRegSuccess:
+		case ResponseCodePong:
+		case ResponseCodePortKeyExist, ResponseCodePortKeyRegSuccess, ResponseCodePortKeyRegDenied,
+			ResponseCodePortKeyUnregSuccess, ResponseCodePortKeyNotExist, ResponseCodePortKeyNotOwned:
 			portKey := string(buf)
-			pk, ok := cfg.GetPort(portKey)
+			pk, ok := serverGetPort(portKey)
 			lf := log.Fields{
 				"port_key": portKey,
 			}
 			if ok {
 				lf["port_mark"] = pk.Mark
 			}
-			if code == ResponseCodePortKeyExist {
+			switch code {
+			case ResponseCodePortKeyExist:
 				l.WithFields(lf).Errorln("failed to register port key because already registered")
-			} else {
+			case ResponseCodePortKeyRegDenied:
+				l.WithFields(lf).Errorln("failed to register port key because master denied it")
+			case ResponseCodePortKeyUnregSuccess:
+				l.WithFields(lf).Infoln("port key unregister success")
+			case ResponseCodePortKeyNotExist:
+				l.WithFields(lf).Warnln("failed to unregister port key because not registered")
+			case ResponseCodePortKeyNotOwned:
+				l.WithFields(lf).Errorln("failed to unregister port key because registered by another server")
+			default:
 				l.WithFields(lf).Infoln("port key register success")
 			}
 		case ResponseCodeNewClientComing:
-			if len(buf) < 4 {
-				continue
-			}
-
-			portKeyLen := buf[0]
-			buf = buf[1:]
-
-			if portKeyLen == 0 || int(portKeyLen) >= len(buf) {
-				continue
-			}
-			portKey := string(buf[:portKeyLen])
-			clientGuid := string(buf[portKeyLen:])
-
-			portCfg, exist := cfg.GetPort(portKey)
-			if !exist {
-				l.WithFields(log.Fields{
-					"port_key":    portKey,
-					"client_guid": clientGuid,
-				}).Errorln("master return a non-existent port key")
-				SendCommand(c, 0x4, append([]byte{RejectCodePortKeyNotExist}, clientGuid...))
-				continue
-			}
-
-			l.WithFields(log.Fields{
-				"port_key":    portKey,
-				"client_guid": clientGuid,
-				"port_mark":   portCfg.Mark,
-			}).Debugln("new client come from master")
-
-			go serverHandleNewClient(c, portCfg, clientGuid)
+			// only masters of older versions announce clients here, they are called back
+			go serverHandleRequest(&clientRequest{
+				control: control,
+				master:  addr,
+			}, buf)
 		default:
 			l.WithFields(log.Fields{
 				"code": int(code),
@@ -104,62 +230,439 @@ ConnectMaster:
 	}
 }
 
-func serverHandleNewClient(master net.Conn, portCfg *config.PortConfig, guid string) {
+func serverGetPort(portKeyId string) (*config.PortConfig, bool) {
+	serverPortsLock.RLock()
+	defer serverPortsLock.RUnlock()
+	return serverConfig.GetPort(portKeyId, serverSalt())
+}
+
+func serverMasterHas(capability uint32) bool {
+	return atomic.LoadUint32(&serverMasterCapabilities)&capability != 0
+}
+
+func serverSalt() string {
+	salt, _ := serverMasterSalt.Load().(string)
+	return salt
+}
+
+// serverWireKey is the port key id sent to master
+func serverWireKey(v *config.PortConfig) []byte {
+	return []byte(v.PortKeyId(serverSalt()))
+}
+
+func serverGetPool(portKey string) *backendPool {
+	serverPortsLock.RLock()
+	defer serverPortsLock.RUnlock()
+	return serverPools[portKey]
+}
+
+// serverBuildPools makes the backend pools of the ports,
+// the old pool of a port is kept if its backends are not changed so that their health is kept
+func serverBuildPools(ports []*config.PortConfig, old map[string]*backendPool) map[string]*backendPool {
+	pools := make(map[string]*backendPool)
+	for _, v := range ports {
+		if v.Protocol == config.ProtocolDynamic {
+			// dials whatever the client asks
+			continue
+		}
+		if p, exist := old[v.PortKey]; exist && p.sameAs(v) {
+			pools[v.PortKey] = p
+			delete(old, v.PortKey)
+			continue
+		}
+		pools[v.PortKey] = newBackendPool(v)
+	}
+	for _, p := range old {
+		p.Close()
+	}
+	return pools
+}
+
+// serverSendControl sends a command to master over the control stream,
+// it does nothing while disconnected because all ports are registered again after reconnecting
+func serverSendControl(command uint8, data []byte) error {
+	serverControlLock.Lock()
+	defer serverControlLock.Unlock()
+	if serverControl == nil {
+		return nil
+	}
+	return SendCommand(serverControl, command, data)
+}
+
+// serverHeartbeat pings master over the control stream until done is closed,
+// master answers with a pong so both sides can tell a dead connection
+func serverHeartbeat(control net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(time.Second * time.Duration(serverConfig.HeartbeatInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			serverControlLock.Lock()
+			if serverControl == control {
+				SendCommand(control, CommandServerPing, nil)
+			}
+			serverControlLock.Unlock()
+		}
+	}
+}
+
+// serverReload reloads the ports from the config file, new port keys are registered and removed ones
+// are unregistered, changed ports take effect on new clients, established bridges are kept
+func serverReload() {
 	l := log.WithFields(log.Fields{
-		"local_addr":  portCfg.LocalAddress,
-		"master":      serverConfig.Master,
-		"client_guid": guid,
-		"port_mark":   portCfg.Mark,
+		"file": ConfigFile,
 	})
 
-	remoteConn, err := net.DialTimeout("tcp", portCfg.LocalAddress, time.Second*8)
+	var cfg *config.ServerConfig
+	err := loadConfig(&cfg)
 	if err != nil {
-		l.WithError(err).Errorln("connect to local address failed")
-		SendCommand(master, CommandServerRejectClientRequest, append([]byte{RejectCodePortKeyRemoteConnectFailed}, []byte(guid)...))
+		l.WithError(err).Errorln("reload configure file failed")
 		return
 	}
-	newMasterConn, err := net.Dial("tcp", serverConfig.Master)
+	err = cfg.Validate()
 	if err != nil {
-		l.WithError(err).Errorln("callback master failed")
+		l.WithError(err).Errorln("validate reloaded configure file failed")
 		return
 	}
-	SendCommand(newMasterConn, CommandServerAcceptClientRequest, []byte(guid))
+	if !reflect.DeepEqual(cfg.Master, serverConfig.Master) || cfg.MasterKey != serverConfig.MasterKey ||
+		cfg.Name != serverConfig.Name || !reflect.DeepEqual(cfg.TLS, serverConfig.TLS) ||
+		cfg.AllowLegacyMaster != serverConfig.AllowLegacyMaster {
+		l.Warnln("only ports are reloaded, restart to apply the changes of master, master_key, name, tls or allow_legacy_master")
+	}
 
-	l.Debugln("client match success")
+	serverPortsLock.Lock()
+	oldPorts := serverConfig.Ports
+	serverConfig.Ports = cfg.Ports
+	serverPools = serverBuildPools(cfg.Ports, serverPools)
+	serverPortsLock.Unlock()
+
+	oldKeys := make(map[string]bool)
+	for _, v := range oldPorts {
+		oldKeys[v.PortKey] = true
+	}
+	newKeys := make(map[string]bool)
+	for _, v := range cfg.Ports {
+		newKeys[v.PortKey] = true
+	}
+
+	for _, v := range cfg.Ports {
+		if oldKeys[v.PortKey] {
+			continue
+		}
+		l.WithFields(log.Fields{
+			"port_mark": v.Mark,
+		}).Infoln("registering new port key")
+		err = serverSendControl(CommandServerRegisterPortKey, serverWireKey(v))
+		if err != nil {
+			l.WithError(err).Errorln("register port key failed")
+		}
+	}
+	for _, v := range oldPorts {
+		if newKeys[v.PortKey] {
+			continue
+		}
+		if !serverMasterHas(CapabilityUnregister) {
+			l.WithFields(log.Fields{
+				"port_mark": v.Mark,
+			}).Warnln("master does not support unregistering port key, the removed one is kept until reconnecting")
+			continue
+		}
+		l.WithFields(log.Fields{
+			"port_mark": v.Mark,
+		}).Infoln("unregistering removed port key")
+		err = serverSendControl(CommandServerUnregisterPortKey, serverWireKey(v))
+		if err != nil {
+			l.WithError(err).Errorln("unregister port key failed")
+		}
+	}
+
+	l.Infoln("configure file reloaded")
+}
 
-	er, ew, err := crypto.GetCrypto(portCfg.EncryptMethod)
+// serverHandshake proves to master that we know the master key and checks that master knows it too,
+// the master key itself never goes over the wire
+func serverHandshake(c net.Conn, addr string) error {
+	serverNonce, err := newAuthNonce()
 	if err != nil {
-		// because check while validate configure
-		panic(err)
+		return err
 	}
-	cr, cw, err := compress.GetCompress(portCfg.CompressMethod)
+	err = SendCommand(c, CommandServerAuthHandshake, append(serverNonce, serverConfig.Name...))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	remoteToMaster, err := ew(portCfg.PortKey, newMasterConn)
+	// we prove first and master proves after checking ours
+	var masterNonce []byte
+	masterProved := false
+	for {
+		buf, err := ReadHandshakeFromSocket(c)
+		if err != nil {
+			return err
+		}
+		code := buf[0]
+		buf = buf[1:]
+
+		switch code {
+		case ResponseCodeAuthChallenge:
+			if len(buf) != AuthNonceSize || masterNonce != nil {
+				return fmt.Errorf("invalid auth challenge")
+			}
+			masterNonce = buf
+			err = SendCommand(c, CommandServerAuthResponse, authProof(serverConfig.MasterKey, serverSalt(), "server", masterNonce, serverNonce))
+			if err != nil {
+				return err
+			}
+		case ResponseCodeAuthProof:
+			if masterNonce == nil || !hmac.Equal(buf, authProof(serverConfig.MasterKey, serverSalt(), "master", serverNonce, masterNonce)) {
+				return fmt.Errorf("master failed to prove that it knows the master key")
+			}
+			masterProved = true
+		case ResponseCodeReady:
+			if !masterProved {
+				return fmt.Errorf("master did not prove that it knows the master key")
+			}
+			return nil
+		case ResponseCodeMasterKeyMismatch:
+			log.WithFields(log.Fields{
+				"master": addr,
+			}).Fatalln("master reported that master key mismatch")
+		case ResponseCodeServerCertRequired:
+			log.WithFields(log.Fields{
+				"master": addr,
+			}).Fatalln("master reported that a verified client certificate (tls.cert) is required")
+		default:
+			return fmt.Errorf("master response an unsupported code %d", code)
+		}
+	}
+}
+
+// serverLegacyHandshake sends the master key in plain text to a master of an older version
+func serverLegacyHandshake(c net.Conn, addr string) error {
+	err := SendCommand(c, CommandServerHandshake, []byte(serverConfig.MasterKey))
 	if err != nil {
-		l.WithError(err).Errorln("init encrypt failed")
-		return
+		return err
 	}
-	remoteToMaster, err = cw(remoteToMaster)
+	buf, err := ReadHandshakeFromSocket(c)
 	if err != nil {
-		l.WithError(err).Errorln("init compress failed")
-		return
+		return err
 	}
+	switch buf[0] {
+	case ResponseCodeReady:
+		return nil
+	case ResponseCodeMasterKeyMismatch:
+		log.WithFields(log.Fields{
+			"master": addr,
+		}).Fatalln("master reported that master key mismatch")
+	}
+	return fmt.Errorf("master response an unsupported code %d", buf[0])
+}
+
+func serverAcceptStreams(session *yamux.Session) {
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+
+		go serverHandleStream(stream)
+	}
+}
+
+// clientRequest is a client announced by master, carried by a stream which master opens,
+// or by a connection which we call back to a master of an older version
+type clientRequest struct {
+	// the stream announcing the client, nil if called back
+	stream net.Conn
+	// the control connection of the master to call back and its address
+	control net.Conn
+	master  string
+	Guid    string
+}
 
-	masterToRemote, err := er(portCfg.PortKey, newMasterConn)
+func (r *clientRequest) RemoteAddr() net.Addr {
+	if r.stream != nil {
+		return r.stream.RemoteAddr()
+	}
+	return r.control.RemoteAddr()
+}
+
+// Accept tells master that the client is accepted, and returns the connection carrying it
+func (r *clientRequest) Accept() (net.Conn, error) {
+	if r.stream != nil {
+		return r.stream, SendCommand(r.stream, CommandServerAcceptClientRequest, []byte(r.Guid))
+	}
+
+	c, err := dialMaster(r.master, serverTLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("callback master failed: %s", err)
+	}
+	err = SendCommand(c, CommandServerAcceptClientRequest, []byte(r.Guid))
 	if err != nil {
-		l.WithError(err).Errorln("init decrypt failed")
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *clientRequest) Reject(code uint8) {
+	data := append([]byte{code}, r.Guid...)
+	if r.stream != nil {
+		SendCommand(r.stream, CommandServerRejectClientRequest, data)
 		return
 	}
-	masterToRemote, err = cr(masterToRemote)
+	serverControlLock.Lock()
+	defer serverControlLock.Unlock()
+	if serverControl == r.control {
+		SendCommand(r.control, CommandServerRejectClientRequest, data)
+	}
+}
+
+func serverHandleStream(stream net.Conn) {
+	l := log.WithFields(log.Fields{
+		"master": stream.RemoteAddr(),
+	})
+
+	ok := false
+	defer func() {
+		if !ok {
+			stream.Close()
+		}
+	}()
+
+	buf, err := ReadFromSocket(stream)
 	if err != nil {
-		l.WithError(err).Errorln("init decompress failed")
+		l.WithError(err).Debugln("read new stream failed")
 		return
 	}
+	code := buf[0]
+	buf = buf[1:]
+
+	if code != ResponseCodeNewClientComing {
+		return
+	}
+	ok = serverHandleRequest(&clientRequest{
+		stream: stream,
+	}, buf)
+}
+
+// serverHandleRequest parses the port key and the guid of a new client and serves it,
+// false is returned if it is not served
+func serverHandleRequest(req *clientRequest, buf []byte) bool {
+	l := log.WithFields(log.Fields{
+		"master": req.RemoteAddr(),
+	})
+
+	if len(buf) < 4 {
+		return false
+	}
+
+	portKeyLen := buf[0]
+	buf = buf[1:]
+
+	if portKeyLen == 0 || int(portKeyLen) >= len(buf) {
+		return false
+	}
+	portKey := string(buf[:portKeyLen])
+	req.Guid = string(buf[portKeyLen:])
+
+	portCfg, exist := serverGetPort(portKey)
+	if !exist {
+		l.WithFields(log.Fields{
+			"port_key":    portKey,
+			"client_guid": req.Guid,
+		}).Errorln("master return a non-existent port key")
+		req.Reject(RejectCodePortKeyNotExist)
+		return false
+	}
+
+	l.WithFields(log.Fields{
+		"port_key":    portKey,
+		"client_guid": req.Guid,
+		"port_mark":   portCfg.Mark,
+	}).Debugln("new client come from master")
+
+	if portCfg.Protocol == config.ProtocolDynamic {
+		return serverHandleDynamicClient(req, portCfg)
+	}
+	return serverHandleNewClient(req, portCfg)
+}
+
+func serverHandleNewClient(req *clientRequest, portCfg *config.PortConfig) bool {
+	l := log.WithFields(log.Fields{
+		"local_addr":  portCfg.Backends(),
+		"master":      req.RemoteAddr(),
+		"client_guid": req.Guid,
+		"port_mark":   portCfg.Mark,
+	})
+
+	pool := serverGetPool(portCfg.PortKey)
+	if pool == nil {
+		// removed by reloading just now
+		pool = newBackendPool(portCfg)
+		pool.Close()
+	}
+	remoteConn, b, err := pool.Dial()
+	if err != nil {
+		l.WithError(err).Errorln("connect to local address failed")
+		serverLocalDialFailures.WithLabelValues(portCfg.Mark).Inc()
+		req.Reject(RejectCodePortKeyRemoteConnectFailed)
+		return false
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			remoteConn.Close()
+		}
+	}()
 
-	// tcp bridge
-	go tcpBridge(remoteConn, remoteToMaster)
-	go tcpBridge(masterToRemote, remoteConn)
+	stream, err := req.Accept()
+	if err != nil {
+		l.WithError(err).Errorln("accept client failed")
+		return false
+	}
+	defer func() {
+		if !ok {
+			stream.Close()
+		}
+	}()
+
+	l.Debugln("client match success")
+
+	masterToRemote, remoteToMaster, err := wrapTunnel(portCfg, stream)
+	if err != nil {
+		l.WithError(err).Errorln("init tunnel failed")
+		return false
+	}
+
+	ok = true
+
+	serverActiveBridges.Inc()
+	atomic.AddInt64(&b.Active, 1)
+	done := func() {
+		serverActiveBridges.Dec()
+		atomic.AddInt64(&b.Active, -1)
+	}
+
+	if portCfg.Protocol == config.ProtocolUDP {
+		go func() {
+			udpBridge(remoteConn, masterToRemote, remoteToMaster)
+			done()
+		}()
+		return true
+	}
+
+	relayPair(remoteConn, remoteToMaster, masterToRemote, remoteConn, nil, nil, func(download, upload RelayResult) {
+		done()
+		l.WithFields(log.Fields{
+			"local_addr":   b.Addr,
+			"upload":       upload.Bytes,
+			"download":     download.Bytes,
+			"upload_end":   upload.Cause(),
+			"download_end": download.Cause(),
+		}).Debugln("bridge closed")
+	})
+	return true
 }
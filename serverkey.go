@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"github.com/crabkun/crab/store"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"sync"
+	"time"
+)
+
+// the server name is sent before authentication, so the keys are looked up through a cache
+// which keeps unknown names too, and the lookups missing the cache are rate limited.
+// otherwise anyone reaching master could make it query the port key store at will
+
+const ServerKeyCacheTTL = time.Minute
+const ServerKeyCacheSize = 4096
+
+// lookups per second missing the cache
+const ServerKeyLookupRate = 10
+
+var errServerKeyLookupLimited = errors.New("too many server key lookups")
+
+type serverKeyEntry struct {
+	// closed after the lookup finished, the fields below are set before
+	done   chan struct{}
+	key    string
+	ok     bool
+	err    error
+	expire time.Time
+}
+
+var serverKeyCache = make(map[string]*serverKeyEntry)
+var serverKeyCacheLock sync.Mutex
+var serverKeyLimiter = rate.NewLimiter(ServerKeyLookupRate, ServerKeyLookupRate*2)
+
+// masterServerKey looks up the key of the named server, concurrent lookups of a name share one
+func masterServerKey(name string) (string, bool, error) {
+	serverKeyCacheLock.Lock()
+	e, exist := serverKeyCache[name]
+	if exist && e.fresh() {
+		serverKeyCacheLock.Unlock()
+		<-e.done
+		return e.key, e.ok, e.err
+	}
+	if !serverKeyLimiter.Allow() {
+		serverKeyCacheLock.Unlock()
+		return "", false, errServerKeyLookupLimited
+	}
+	if len(serverKeyCache) >= ServerKeyCacheSize {
+		for k, v := range serverKeyCache {
+			if !v.fresh() {
+				delete(serverKeyCache, k)
+			}
+		}
+		if len(serverKeyCache) >= ServerKeyCacheSize {
+			serverKeyCache = make(map[string]*serverKeyEntry)
+		}
+	}
+	e = &serverKeyEntry{
+		done: make(chan struct{}),
+	}
+	serverKeyCache[name] = e
+	serverKeyCacheLock.Unlock()
+
+	e.key, e.ok, e.err = masterStore.ServerKey(name)
+	// errors are not cached
+	if e.err == nil {
+		e.expire = time.Now().Add(ServerKeyCacheTTL)
+	}
+	if _, open := masterStore.(*store.OpenStore); !open && e.err == nil && !e.ok && name != "" {
+		log.WithFields(log.Fields{
+			"server_name": name,
+		}).Infoln("server is not known by the port key store, it authenticates with the master key")
+	}
+	close(e.done)
+	return e.key, e.ok, e.err
+}
+
+// fresh tells whether the entry is being looked up or not expired yet
+func (e *serverKeyEntry) fresh() bool {
+	select {
+	case <-e.done:
+		return time.Now().Before(e.expire)
+	default:
+		return true
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/crabkun/crab/config"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+)
+
+// a socks5 port is a socks5 proxy without authentication (rfc 1928),
+// the targets of CONNECT and UDP ASSOCIATE are dialed by the server of the port key
+
+const (
+	Socks5Version = 5
+
+	Socks5MethodNoAuth       = 0
+	Socks5MethodNoAcceptable = 0xFF
+
+	Socks5CommandConnect      = 1
+	Socks5CommandUdpAssociate = 3
+
+	Socks5AddrIPv4   = 1
+	Socks5AddrDomain = 3
+	Socks5AddrIPv6   = 4
+
+	Socks5ReplySuccess             = 0
+	Socks5ReplyGeneralFailure      = 1
+	Socks5ReplyNotAllowed          = 2
+	Socks5ReplyHostUnreachable     = 4
+	Socks5ReplyCommandNotSupported = 7
+	Socks5ReplyAddrNotSupported    = 8
+)
+
+func clientHandleSocks5(remote net.Conn, cfg *config.PortConfig) {
+	l := log.WithFields(log.Fields{
+		"port_mark":   cfg.Mark,
+		"listen_at":   cfg.LocalAddress,
+		"remote_addr": remote.RemoteAddr(),
+	})
+
+	// disconnect if not handshake in 10s
+	remote.SetDeadline(time.Now().Add(time.Second * 10))
+
+	command, target, err := socks5Handshake(remote)
+	if err != nil {
+		l.WithError(err).Debugln("socks5 handshake failed")
+		remote.Close()
+		return
+	}
+
+	l = l.WithFields(log.Fields{
+		"target": target,
+	})
+
+	switch command {
+	case Socks5CommandConnect:
+		clientSocks5Connect(remote, cfg, target, l)
+	case Socks5CommandUdpAssociate:
+		clientSocks5UdpAssociate(remote, cfg, l)
+	}
+}
+
+// socks5Handshake negotiates the method and reads the request, unsupported requests are replied
+func socks5Handshake(c net.Conn) (uint8, string, error) {
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(c, buf)
+	if err != nil {
+		return 0, "", err
+	}
+	if buf[0] != Socks5Version {
+		return 0, "", fmt.Errorf("unsupported socks version %d", buf[0])
+	}
+	methods := make([]byte, buf[1])
+	_, err = io.ReadFull(c, methods)
+	if err != nil {
+		return 0, "", err
+	}
+	if bytes.IndexByte(methods, Socks5MethodNoAuth) < 0 {
+		c.Write([]byte{Socks5Version, Socks5MethodNoAcceptable})
+		return 0, "", fmt.Errorf("no acceptable method")
+	}
+	_, err = c.Write([]byte{Socks5Version, Socks5MethodNoAuth})
+	if err != nil {
+		return 0, "", err
+	}
+
+	// VER CMD RSV
+	buf = make([]byte, 3)
+	_, err = io.ReadFull(c, buf)
+	if err != nil {
+		return 0, "", err
+	}
+	if buf[0] != Socks5Version {
+		return 0, "", fmt.Errorf("unsupported socks version %d", buf[0])
+	}
+	command := buf[1]
+	target, err := readSocks5Addr(c)
+	if err != nil {
+		socks5Reply(c, Socks5ReplyAddrNotSupported, nil)
+		return 0, "", err
+	}
+	if command != Socks5CommandConnect && command != Socks5CommandUdpAssociate {
+		socks5Reply(c, Socks5ReplyCommandNotSupported, nil)
+		return 0, "", fmt.Errorf("unsupported command %d", command)
+	}
+	return command, target, nil
+}
+
+// readSocks5Addr reads ATYP DST.ADDR DST.PORT as host:port
+func readSocks5Addr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case Socks5AddrIPv4, Socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == Socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		_, err = io.ReadFull(r, ip)
+		if err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case Socks5AddrDomain:
+		_, err = io.ReadFull(r, atyp)
+		if err != nil {
+			return "", err
+		}
+		domain := make([]byte, atyp[0])
+		_, err = io.ReadFull(r, domain)
+		if err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", atyp[0])
+	}
+
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendSocks5Addr appends addr as ATYP BND.ADDR BND.PORT, nil is 0.0.0.0:0
+func appendSocks5Addr(buf []byte, addr *net.UDPAddr) []byte {
+	if addr == nil {
+		addr = &net.UDPAddr{IP: net.IPv4zero}
+	}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		buf = append(buf, Socks5AddrIPv4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, Socks5AddrIPv6)
+		buf = append(buf, addr.IP.To16()...)
+	}
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(addr.Port))
+	return append(buf, port...)
+}
+
+func socks5Reply(c net.Conn, code uint8, bind *net.UDPAddr) error {
+	_, err := c.Write(appendSocks5Addr([]byte{Socks5Version, code, 0}, bind))
+	return err
+}
+
+func socks5ReplyCode(status uint8) uint8 {
+	switch status {
+	case DynamicDialSuccess:
+		return Socks5ReplySuccess
+	case DynamicDialDenied:
+		return Socks5ReplyNotAllowed
+	default:
+		return Socks5ReplyHostUnreachable
+	}
+}
+
+func clientSocks5Connect(remote net.Conn, cfg *config.PortConfig, target string, l *log.Entry) {
+	masterToRemote, remoteToMaster, status := clientDialDynamic(cfg, DynamicNetworkTCP, target, l)
+	if status != DynamicDialSuccess {
+		socks5Reply(remote, socks5ReplyCode(status), nil)
+		remote.Close()
+		return
+	}
+
+	err := socks5Reply(remote, Socks5ReplySuccess, nil)
+	if err != nil {
+		remote.Close()
+		remoteToMaster.Close()
+		return
+	}
+	remote.SetDeadline(time.Time{})
+
+	clientActiveConnections.Inc()
+
+	relayPair(remote, remoteToMaster, masterToRemote, remote, nil, nil, func(up, down RelayResult) {
+		clientActiveConnections.Dec()
+		l.WithFields(log.Fields{
+			"upload":       up.Bytes,
+			"download":     down.Bytes,
+			"upload_end":   up.Cause(),
+			"download_end": down.Cause(),
+		}).Debugln("connection closed")
+	})
+}
+
+// clientSocks5UdpAssociate relays the datagrams of the socks5 client through one tunnel,
+// the association ends with the tcp connection of the request
+func clientSocks5UdpAssociate(remote net.Conn, cfg *config.PortConfig, l *log.Entry) {
+	defer remote.Close()
+
+	// the relay listens at the same ip as the port
+	localIP := remote.LocalAddr().(*net.TCPAddr).IP
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		l.WithError(err).Errorln("listen udp relay failed")
+		socks5Reply(remote, Socks5ReplyGeneralFailure, nil)
+		return
+	}
+	defer conn.Close()
+
+	masterToRemote, remoteToMaster, status := clientDialDynamic(cfg, DynamicNetworkUDP, "", l)
+	if status != DynamicDialSuccess {
+		socks5Reply(remote, socks5ReplyCode(status), nil)
+		return
+	}
+	defer func() {
+		masterToRemote.Close()
+		remoteToMaster.Close()
+	}()
+
+	err = socks5Reply(remote, Socks5ReplySuccess, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return
+	}
+	remote.SetDeadline(time.Time{})
+
+	l.WithFields(log.Fields{
+		"relay_addr": conn.LocalAddr(),
+	}).Debugln("udp associate started")
+
+	clientActiveConnections.Inc()
+	defer clientActiveConnections.Dec()
+
+	// only datagrams from the ip of the socks5 client are relayed,
+	// the port is learned from the first one
+	clientIP := remote.RemoteAddr().(*net.TCPAddr).IP
+	clientAddr := make(chan *net.UDPAddr, 1)
+
+	go func() {
+		defer remoteToMaster.Close()
+		learned := false
+		buf := make([]byte, UdpMaxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !addr.IP.Equal(clientIP) {
+				continue
+			}
+			if !learned {
+				learned = true
+				clientAddr <- addr
+			}
+
+			// RSV FRAG, fragments are not supported
+			if n < 3 || buf[2] != 0 {
+				continue
+			}
+			r := bytes.NewReader(buf[3:n])
+			target, err := readSocks5Addr(r)
+			if err != nil {
+				continue
+			}
+			data, err := packDynamicDatagram(target, buf[n-r.Len():n])
+			if err != nil {
+				continue
+			}
+			if writeDatagram(remoteToMaster, data) != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer remote.Close()
+		var dst *net.UDPAddr
+		for {
+			buf, err := readDatagram(masterToRemote)
+			if err != nil {
+				return
+			}
+			source, data, err := unpackDynamicDatagram(buf)
+			if err != nil {
+				return
+			}
+			if dst == nil {
+				select {
+				case dst = <-clientAddr:
+				default:
+					// nothing sent yet, so nothing to reply
+					continue
+				}
+			}
+			sourceAddr, err := net.ResolveUDPAddr("udp", source)
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(append(appendSocks5Addr([]byte{0, 0, 0}, sourceAddr), data...), dst)
+		}
+	}()
+
+	// the socks5 client sends nothing more, reading only tells that it is gone
+	io.Copy(ioutil.Discard, remote)
+	l.Debugln("udp associate closed")
+}
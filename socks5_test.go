@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// scriptConn reads a script and records the writes
+type scriptConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *scriptConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
+
+func (c *scriptConn) Write(buf []byte) (int, error) {
+	return c.w.Write(buf)
+}
+
+func TestSocks5Handshake(t *testing.T) {
+	greeting := []byte{Socks5Version, 1, Socks5MethodNoAuth}
+	accepted := []byte{Socks5Version, Socks5MethodNoAuth}
+	request := func(command uint8, addr ...byte) []byte {
+		return append(append(append([]byte{}, greeting...), Socks5Version, command, 0), addr...)
+	}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		command uint8
+		target  string
+		fail    bool
+		// replied before the request is handed over, or before failing
+		reply []byte
+	}{
+		{"connect ipv4", request(Socks5CommandConnect, Socks5AddrIPv4, 10, 0, 0, 1, 0, 80),
+			Socks5CommandConnect, "10.0.0.1:80", false, accepted},
+		{"connect ipv6", request(Socks5CommandConnect, append(append([]byte{Socks5AddrIPv6}, net.ParseIP("::1")...), 1, 187)...),
+			Socks5CommandConnect, "[::1]:443", false, accepted},
+		{"connect domain", request(Socks5CommandConnect, append([]byte{Socks5AddrDomain, 11}, "example.com\x00\x50"...)...),
+			Socks5CommandConnect, "example.com:80", false, accepted},
+		{"udp associate", request(Socks5CommandUdpAssociate, Socks5AddrIPv4, 0, 0, 0, 0, 0, 0),
+			Socks5CommandUdpAssociate, "0.0.0.0:0", false, accepted},
+		{"no auth among methods", append([]byte{Socks5Version, 3, 2, 1, Socks5MethodNoAuth, Socks5Version, Socks5CommandConnect, 0},
+			Socks5AddrIPv4, 10, 0, 0, 1, 0, 80), Socks5CommandConnect, "10.0.0.1:80", false, accepted},
+		{"socks4", []byte{4, 1, 0, 80, 10, 0, 0, 1, 0}, 0, "", true, nil},
+		{"no acceptable method", []byte{Socks5Version, 1, 2}, 0, "", true,
+			[]byte{Socks5Version, Socks5MethodNoAcceptable}},
+		{"bind", request(2, Socks5AddrIPv4, 10, 0, 0, 1, 0, 80), 0, "", true,
+			append(append([]byte{}, accepted...), socks5ReplyBytes(Socks5ReplyCommandNotSupported)...)},
+		{"unknown address type", request(Socks5CommandConnect, 5, 0), 0, "", true,
+			append(append([]byte{}, accepted...), socks5ReplyBytes(Socks5ReplyAddrNotSupported)...)},
+		{"truncated request", request(Socks5CommandConnect, Socks5AddrIPv4, 10, 0), 0, "", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &scriptConn{r: bytes.NewReader(tt.input)}
+			command, target, err := socks5Handshake(c)
+			if tt.fail != (err != nil) {
+				t.Fatalf("error %v", err)
+			}
+			if command != tt.command || target != tt.target {
+				t.Fatalf("command %d target %q", command, target)
+			}
+			if tt.reply != nil && !bytes.Equal(c.w.Bytes(), tt.reply) {
+				t.Fatalf("replied %v instead of %v", c.w.Bytes(), tt.reply)
+			}
+		})
+	}
+}
+
+func socks5ReplyBytes(code uint8) []byte {
+	var c scriptConn
+	socks5Reply(&c, code, nil)
+	return c.w.Bytes()
+}
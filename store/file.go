@@ -0,0 +1,169 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/crabkun/crab/config"
+	"github.com/crabkun/crab/crypto"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fileServer struct {
+	Name string `json:"name" yaml:"name"`
+	Key  string `json:"key" yaml:"key"`
+}
+
+type filePortKey struct {
+	// either the port key or its id
+	PortKey   string `json:"port_key" yaml:"port_key"`
+	PortKeyId string `json:"port_key_id" yaml:"port_key_id"`
+	// the server allowed to register it, empty for any server
+	Server string `json:"server" yaml:"server"`
+	// ip or cidr of clients allowed to connect to it, empty for any client
+	Clients   []string                `json:"clients" yaml:"clients"`
+	RateLimit *config.RateLimitConfig `json:"rate_limit" yaml:"rate_limit"`
+}
+
+type fileContent struct {
+	Servers  []*fileServer  `json:"servers" yaml:"servers"`
+	PortKeys []*filePortKey `json:"port_keys" yaml:"port_keys"`
+}
+
+// FileStore reads a static json or yaml file, the file is reloaded after it was modified
+type FileStore struct {
+	path string
+	// of master, port keys in the file are turned into ids with it
+	salt string
+
+	lock     sync.RWMutex
+	modTime  time.Time
+	servers  map[string]*fileServer
+	portKeys map[string]*filePortKey
+}
+
+func NewFileStore(path string, salt string) (*FileStore, error) {
+	s := &FileStore{
+		path: path,
+		salt: salt,
+	}
+	return s, s.reload()
+}
+
+func (s *FileStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.lock.RLock()
+	modified := !info.ModTime().Equal(s.modTime)
+	s.lock.RUnlock()
+	if !modified {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	var content fileContent
+	switch strings.ToLower(filepath.Ext(s.path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(buf, &content)
+	default:
+		err = json.Unmarshal(buf, &content)
+	}
+	if err != nil {
+		return fmt.Errorf("unmarshal %s failed: %s", s.path, err)
+	}
+
+	servers := make(map[string]*fileServer)
+	for _, v := range content.Servers {
+		servers[v.Name] = v
+	}
+	portKeys := make(map[string]*filePortKey)
+	for i, v := range content.PortKeys {
+		id := v.PortKeyId
+		if v.PortKey != "" {
+			id = crypto.PortKeyId(v.PortKey, s.salt)
+		}
+		if id == "" {
+			return fmt.Errorf("port key (at pos %d) has neither port_key nor port_key_id", i)
+		}
+		portKeys[id] = v
+	}
+
+	s.lock.Lock()
+	s.modTime = info.ModTime()
+	s.servers = servers
+	s.portKeys = portKeys
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *FileStore) ServerKey(server string) (string, bool, error) {
+	if err := s.reload(); err != nil {
+		return "", false, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v, ok := s.servers[server]
+	if !ok {
+		return "", false, nil
+	}
+	return v.Key, true, nil
+}
+
+func (s *FileStore) AllowRegister(server string, portKeyId string) (bool, error) {
+	if err := s.reload(); err != nil {
+		return false, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v, ok := s.portKeys[portKeyId]
+	if !ok {
+		return false, nil
+	}
+	return v.Server == "" || v.Server == server, nil
+}
+
+func (s *FileStore) AllowConnect(portKeyId string, clientAddr string) (bool, error) {
+	if err := s.reload(); err != nil {
+		return false, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v, ok := s.portKeys[portKeyId]
+	if !ok {
+		return false, nil
+	}
+	return clientAllowed(v.Clients, clientAddr), nil
+}
+
+func (s *FileStore) RateLimit(portKeyId string) (*config.RateLimitConfig, bool, error) {
+	if err := s.reload(); err != nil {
+		return nil, false, err
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v, ok := s.portKeys[portKeyId]
+	if !ok || v.RateLimit == nil {
+		return nil, false, nil
+	}
+	return v.RateLimit, true, nil
+}
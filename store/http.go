@@ -0,0 +1,123 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/crabkun/crab/config"
+	"net/http"
+	"time"
+)
+
+type httpRequest struct {
+	Action     string `json:"action"`
+	Server     string `json:"server,omitempty"`
+	PortKeyId  string `json:"port_key_id,omitempty"`
+	ClientAddr string `json:"client_addr,omitempty"`
+}
+
+type httpResponse struct {
+	Allow     bool                    `json:"allow"`
+	Key       string                  `json:"key"`
+	RateLimit *config.RateLimitConfig `json:"rate_limit"`
+}
+
+// HttpStore asks a webhook, every decision is a POST of a json object whose action is
+// server_key, register, connect or rate_limit, the webhook answers
+// {"allow": bool, "key": string, "rate_limit": object}
+type HttpStore struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func NewHttpStore(url string, token string) *HttpStore {
+	return &HttpStore{
+		url:   url,
+		token: token,
+		client: &http.Client{
+			Timeout: time.Second * 3,
+		},
+	}
+}
+
+func (s *HttpStore) ask(req *httpRequest) (*httpResponse, error) {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	httpResp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("webhook response status %d", httpResp.StatusCode)
+	}
+
+	var resp httpResponse
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (s *HttpStore) ServerKey(server string) (string, bool, error) {
+	resp, err := s.ask(&httpRequest{
+		Action: "server_key",
+		Server: server,
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return resp.Key, resp.Allow && resp.Key != "", nil
+}
+
+func (s *HttpStore) AllowRegister(server string, portKeyId string) (bool, error) {
+	resp, err := s.ask(&httpRequest{
+		Action:    "register",
+		Server:    server,
+		PortKeyId: portKeyId,
+	})
+	if err != nil {
+		return false, err
+	}
+	return resp.Allow, nil
+}
+
+func (s *HttpStore) AllowConnect(portKeyId string, clientAddr string) (bool, error) {
+	resp, err := s.ask(&httpRequest{
+		Action:     "connect",
+		PortKeyId:  portKeyId,
+		ClientAddr: clientAddr,
+	})
+	if err != nil {
+		return false, err
+	}
+	return resp.Allow, nil
+}
+
+// RateLimit is asked for every connection, a webhook not answering rate_limit leaves the port key
+// to the master config
+func (s *HttpStore) RateLimit(portKeyId string) (*config.RateLimitConfig, bool, error) {
+	resp, err := s.ask(&httpRequest{
+		Action:    "rate_limit",
+		PortKeyId: portKeyId,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return resp.RateLimit, resp.RateLimit != nil, nil
+}
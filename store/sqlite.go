@@ -0,0 +1,106 @@
+//go:build cgo
+
+package store
+
+import (
+	"database/sql"
+	"github.com/crabkun/crab/config"
+	_ "github.com/mattn/go-sqlite3"
+	"strings"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS servers (
+	name TEXT PRIMARY KEY,
+	key  TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS port_keys (
+	port_key_id TEXT PRIMARY KEY,
+	server      TEXT NOT NULL DEFAULT '',
+	clients     TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS rate_limits (
+	port_key_id   TEXT PRIMARY KEY,
+	upload        INTEGER NOT NULL DEFAULT 0,
+	download      INTEGER NOT NULL DEFAULT 0,
+	conn_upload   INTEGER NOT NULL DEFAULT 0,
+	conn_download INTEGER NOT NULL DEFAULT 0
+);
+`
+
+// SqliteStore keeps servers, port keys and rate limits in an embedded sqlite database,
+// clients of a port key is a comma separated list of ip or cidr. it needs cgo
+type SqliteStore struct {
+	db *sql.DB
+}
+
+func NewSqliteStore(path string) (*SqliteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SqliteStore{
+		db: db,
+	}, nil
+}
+
+func (s *SqliteStore) ServerKey(server string) (string, bool, error) {
+	var key string
+	err := s.db.QueryRow("SELECT key FROM servers WHERE name = ?", server).Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return key, true, nil
+}
+
+func (s *SqliteStore) AllowRegister(server string, portKeyId string) (bool, error) {
+	var owner string
+	err := s.db.QueryRow("SELECT server FROM port_keys WHERE port_key_id = ?", portKeyId).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return owner == "" || owner == server, nil
+}
+
+func (s *SqliteStore) AllowConnect(portKeyId string, clientAddr string) (bool, error) {
+	var clients string
+	err := s.db.QueryRow("SELECT clients FROM port_keys WHERE port_key_id = ?", portKeyId).Scan(&clients)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var rules []string
+	if clients != "" {
+		rules = strings.Split(clients, ",")
+	}
+	return clientAllowed(rules, clientAddr), nil
+}
+
+func (s *SqliteStore) RateLimit(portKeyId string) (*config.RateLimitConfig, bool, error) {
+	limit := &config.RateLimitConfig{
+		PortKeyId: portKeyId,
+	}
+	err := s.db.QueryRow("SELECT upload, download, conn_upload, conn_download FROM rate_limits WHERE port_key_id = ?", portKeyId).
+		Scan(&limit.Upload, &limit.Download, &limit.ConnUpload, &limit.ConnDownload)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return limit, true, nil
+}
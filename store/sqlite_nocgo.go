@@ -0,0 +1,12 @@
+//go:build !cgo
+
+package store
+
+import (
+	"errors"
+)
+
+// NewSqliteStore fails in binaries built without cgo, which the sqlite driver needs
+func NewSqliteStore(path string) (PortKeyStore, error) {
+	return nil, errors.New("sqlite port key store (port_key_store.type) unsupported, the binary is built without cgo")
+}
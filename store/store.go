@@ -0,0 +1,96 @@
+package store
+
+import (
+	"fmt"
+	"github.com/crabkun/crab/config"
+	"net"
+	"strings"
+)
+
+// PortKeyStore decides which server may register which port key and which client may connect to it,
+// port keys are identified by their id (see crypto.PortKeyId) because master never sees the port key itself
+type PortKeyStore interface {
+	// ServerKey returns the key the named server authenticates with,
+	// ok is false if the store doesn't know the server and the master key should be used
+	ServerKey(server string) (key string, ok bool, err error)
+	// AllowRegister reports whether the server may register the port key
+	AllowRegister(server string, portKeyId string) (bool, error)
+	// AllowConnect reports whether the client may connect to the port key
+	AllowConnect(portKeyId string, clientAddr string) (bool, error)
+	RateLimitStore
+}
+
+// RateLimitStore keeps rate limits of port keys, which take precedence over the master config,
+// ok is false if the store has no limit for the port key
+type RateLimitStore interface {
+	RateLimit(portKeyId string) (limit *config.RateLimitConfig, ok bool, err error)
+}
+
+// New creates the port key store, salt is the one of port key ids
+func New(cfg *config.PortKeyStoreConfig, salt string) (PortKeyStore, error) {
+	if cfg == nil {
+		return &OpenStore{}, nil
+	}
+
+	switch strings.ToLower(cfg.Type) {
+	case "file":
+		return NewFileStore(cfg.Path, salt)
+	case "sqlite":
+		return NewSqliteStore(cfg.Path)
+	case "http":
+		return NewHttpStore(cfg.Url, cfg.Token), nil
+	default:
+		return nil, fmt.Errorf("unsupported port key store %s", cfg.Type)
+	}
+}
+
+// OpenStore lets every server holding the master key register any port key, and every client connect to it
+type OpenStore struct{}
+
+func (s *OpenStore) ServerKey(server string) (string, bool, error) {
+	return "", false, nil
+}
+
+func (s *OpenStore) AllowRegister(server string, portKeyId string) (bool, error) {
+	return true, nil
+}
+
+func (s *OpenStore) AllowConnect(portKeyId string, clientAddr string) (bool, error) {
+	return true, nil
+}
+
+func (s *OpenStore) RateLimit(portKeyId string) (*config.RateLimitConfig, bool, error) {
+	return nil, false, nil
+}
+
+// clientAllowed reports whether the ip of addr matches one of the ip or cidr rules,
+// empty rules allow every client
+func clientAllowed(rules []string, addr string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, v := range rules {
+		v = strings.TrimSpace(v)
+		if strings.Contains(v, "/") {
+			_, ipNet, err := net.ParseCIDR(v)
+			if err == nil && ipNet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if ruleIp := net.ParseIP(v); ruleIp != nil && ruleIp.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"github.com/crabkun/crab/compress"
+	"github.com/crabkun/crab/config"
+	"github.com/crabkun/crab/crypto"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// the layers of a tunnel are given a halfCloser, so closing the writer layers flushes them
+// and ends the writing side only, the connection is closed by tunnelReader or tunnelWriter
+type halfCloser struct {
+	net.Conn
+}
+
+func (c halfCloser) Close() error {
+	return closeWrite(c.Conn)
+}
+
+type tunnelReader struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (r *tunnelReader) Close() error {
+	r.ReadCloser.Close()
+	return r.conn.Close()
+}
+
+// SetReadDeadline times out the reads of the connection, a timed out tunnel can't be read any more
+func (r *tunnelReader) SetReadDeadline(t time.Time) error {
+	return r.conn.SetReadDeadline(t)
+}
+
+type tunnelWriter struct {
+	io.WriteCloser
+	conn net.Conn
+	once sync.Once
+	err  error
+}
+
+// CloseWrite tells the peer that nothing more will be written, it may still write back
+func (w *tunnelWriter) CloseWrite() error {
+	w.once.Do(func() {
+		w.err = w.WriteCloser.Close()
+	})
+	return w.err
+}
+
+func (w *tunnelWriter) Close() error {
+	// closing the connection first unblocks the layers if they are waiting for the peer
+	err := w.conn.Close()
+	w.CloseWrite()
+	return err
+}
+
+// wrapTunnel wraps the connection to master with the encrypt and compress method of the port,
+// returning the reader and writer of plain traffic. CloseWrite of the writer only ends the writing side,
+// Close of either one closes the connection
+func wrapTunnel(portCfg *config.PortConfig, master net.Conn) (io.ReadCloser, io.WriteCloser, error) {
+	ef, err := crypto.GetCryptoPair(portCfg.EncryptMethod)
+	if err != nil {
+		// checked while validate configure
+		panic(err)
+	}
+	cr, cw, err := compress.GetCompress(portCfg.CompressMethod)
+	if err != nil {
+		panic(err)
+	}
+
+	r, w, err := ef(portCfg.PortKey, halfCloser{master})
+	if err != nil {
+		return nil, nil, fmt.Errorf("init encrypt failed: %s", err)
+	}
+
+	w, err = cw(w)
+	if err != nil {
+		return nil, nil, fmt.Errorf("init compress failed: %s", err)
+	}
+	r, err = cr(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("init decompress failed: %s", err)
+	}
+
+	return &tunnelReader{ReadCloser: r, conn: master}, &tunnelWriter{WriteCloser: w, conn: master}, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const UdpMaxDatagramSize = 0xFFFF
+
+// datagrams are framed with a 2 bytes length prefix while passing through the tunnel
+func writeDatagram(w io.Writer, data []byte) error {
+	if len(data) > UdpMaxDatagramSize {
+		return fmt.Errorf("datagram too long")
+	}
+
+	// one write per datagram so that the compress layer flushes it as a whole
+	buf := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[2:], data)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readDatagram(r io.Reader) ([]byte, error) {
+	l := make([]byte, 2)
+	_, err := io.ReadFull(r, l)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(l))
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// udpBridge relays datagrams between a connected udp socket and the tunnel,
+// it returns after the tunnel was closed
+func udpBridge(conn net.Conn, r io.ReadCloser, w io.WriteCloser) {
+	go func() {
+		defer func() {
+			conn.Close()
+			w.Close()
+		}()
+		buf := make([]byte, UdpMaxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if writeDatagram(w, buf[:n]) != nil {
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		r.Close()
+		conn.Close()
+	}()
+	for {
+		data, err := readDatagram(r)
+		if err != nil {
+			return
+		}
+		conn.Write(data)
+	}
+}
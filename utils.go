@@ -1,67 +1,62 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
+	"crypto/tls"
 	"net"
+	"time"
 )
 
-func ReadFromSocket(c net.Conn) ([]byte, error) {
-	l := make([]byte, 2)
-
-	n, err := c.Read(l)
-	if err != nil {
-		return nil, err
-	}
-	if n != 2 {
-		return nil, fmt.Errorf("read packet length failed, want 2 got %d", n)
-	}
-
-	length := binary.BigEndian.Uint16(l)
-	if length == 0 {
-		return nil, fmt.Errorf("read packet length failed, got zero length")
-	}
-
-	buf := make([]byte, length)
+const MasterDialTimeout = time.Second * 8
 
-	n, err = c.Read(buf)
-	if err != nil {
-		return nil, fmt.Errorf("read packet failed, want %d got %d", length, n)
+// dialMaster dials master in plain tcp if tlsConfig is nil, the tls handshake is included in the timeout
+func dialMaster(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: MasterDialTimeout,
 	}
-	if uint16(n) != length {
-		return nil, fmt.Errorf("read packet length failed, want 2 got %d", n)
+	if tlsConfig == nil {
+		return dialer.Dial("tcp", addr)
 	}
+	return tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+}
 
-	return buf, nil
+// ReadFromSocket reads a whole packet, io.EOF is returned only if the connection is closed between packets
+func ReadFromSocket(c net.Conn) ([]byte, error) {
+	return NewFrameReader(c, MaxPacketSize()).ReadFrame()
 }
 
-func WriteToSocket(c net.Conn, data []byte) error {
-	if len(data) > 0xFFFF {
-		return fmt.Errorf("packet too long")
+// ReadHandshakeFromSocket reads a packet from a side not authenticated yet,
+// which is never longer than HandshakePacketSize
+func ReadHandshakeFromSocket(c net.Conn) ([]byte, error) {
+	size := MaxPacketSize()
+	if size > HandshakePacketSize {
+		size = HandshakePacketSize
 	}
+	return NewFrameReader(c, size).ReadFrame()
+}
 
-	lenBuf := make([]byte, 2)
-	binary.BigEndian.PutUint16(lenBuf, uint16(len(data)))
-
-	buf := bytes.NewBuffer(lenBuf)
-	buf.Write(data)
+// ShortPacketSize is the longest packet that sides without CapabilityLongPacket can read
+const ShortPacketSize = 0xFFFF
 
-	n, err := c.Write(buf.Bytes())
-	if err != nil {
-		return err
-	}
-	if n != buf.Len() {
-		return fmt.Errorf("write packet failed, packet length %d sent %d", buf.Len(), n)
+// packetSizeLimit is the longest packet to write to the other side of the capabilities
+func packetSizeLimit(capabilities uint32) int {
+	size := MaxPacketSize()
+	if capabilities&CapabilityLongPacket == 0 && size > ShortPacketSize {
+		return ShortPacketSize
 	}
+	return size
+}
 
-	return nil
+// WriteToSocket writes the packet after its length, packets longer than 0xFFFF
+// are refused unless the other side has CapabilityLongPacket
+func WriteToSocket(c net.Conn, data []byte, capabilities uint32) error {
+	return NewFrameWriter(c, packetSizeLimit(capabilities)).WriteFrame(data)
 }
 
+// Response and SendCommand write packets which fit in 0xFFFF, so that any side can read them
 func Response(c net.Conn, code uint8, data []byte) error {
-	return WriteToSocket(c, append([]byte{code}, data...))
+	return WriteToSocket(c, append([]byte{code}, data...), 0)
 }
 
 func SendCommand(c net.Conn, command uint8, data []byte) error {
-	return WriteToSocket(c, append([]byte{command}, data...))
+	return WriteToSocket(c, append([]byte{command}, data...), 0)
 }